@@ -4,31 +4,374 @@ import (
 	"cftools-relay/handler"
 	"cftools-relay/internal"
 	"cftools-relay/internal/adapter"
+	"cftools-relay/internal/domain"
+	"cftools-relay/internal/metrics"
 	"code.cloudfoundry.org/lager"
+	"context"
+	"errors"
+	"fmt"
+	"io"
 	"net/http"
 	"os"
+	"os/signal"
+	"path/filepath"
 	"strconv"
+	"sync"
+	"syscall"
+	"time"
+	// the time zones of filter schedules are available on systems without a time zone database, too.
+	_ "time/tzdata"
+)
+
+const (
+	configPath      = "./config.json"
+	historyDatabase = "history.db"
+
+	historyCompactionInterval = time.Hour
+	// historySizeMaxAge is how long the size of the history is reused, so both history gauges of a scrape walk the
+	// storage only once.
+	historySizeMaxAge = 10 * time.Second
 )
 
 func main() {
 	logger := lager.NewLogger("cftools-relay")
 	logger.RegisterSink(lager.NewWriterSink(os.Stdout, lager.INFO))
 
-	c, err := internal.NewConfig("./config.json", logger)
+	command := ""
+	if len(os.Args) > 1 {
+		command = os.Args[1]
+	}
+	switch command {
+	case "validate":
+		path := configPath
+		if len(os.Args) > 2 {
+			path = os.Args[2]
+		}
+		os.Exit(validate(path, logger))
+	case "migrate-config":
+		migrateConfig(logger)
+	case "redrive-dead-letters":
+		redriveDeadLetters(loadConfig(logger), logger)
+	case "import-history":
+		importHistory(loadConfig(logger), logger)
+	case "":
+		serve(loadConfig(logger), logger)
+	default:
+		fmt.Printf("unknown command %q, expected one of: validate, migrate-config, redrive-dead-letters, import-history\n", command)
+		os.Exit(2)
+	}
+}
+
+func loadConfig(logger lager.Logger) internal.Config {
+	c, err := internal.NewConfig(configPath, logger)
 	if err != nil {
+		var problems internal.ValidationErrors
+		if errors.As(err, &problems) {
+			for _, p := range problems {
+				logger.Error("config-validation", p)
+			}
+		}
 		logger.Fatal("config", err)
 	}
+	return c
+}
+
+func validate(path string, logger lager.Logger) int {
+	if _, err := os.Stat(path); err != nil {
+		fmt.Printf("can not read config: %s\n", err.Error())
+		return 1
+	}
+	c, err := internal.LoadConfig(path, logger)
+	var problems internal.ValidationErrors
+	if errors.As(err, &problems) {
+		for _, p := range problems {
+			fmt.Println(p.Error())
+		}
+		fmt.Printf("%s has %d problem(s)\n", path, len(problems))
+		return 1
+	} else if err != nil {
+		fmt.Printf("can not read config: %s\n", err.Error())
+		return 1
+	}
+	for _, w := range c.Warnings() {
+		fmt.Printf("warning: %s\n", w.Error())
+	}
+	fmt.Printf("%s is valid\n", path)
+	return 0
+}
+
+func migrateConfig(logger lager.Logger) {
+	backup, err := internal.MigrateConfig(configPath, logger)
+	if err != nil {
+		logger.Fatal("migrate-config", err)
+	}
+	if backup == "" {
+		logger.Info("migrate-config", lager.Data{"result": "config is up-to-date"})
+		return
+	}
+	logger.Info("migrate-config", lager.Data{"result": "config migrated", "backup": backup})
+}
+
+type reloadable interface {
+	Reload(t map[string]domain.Target, s map[string]domain.Server, filter domain.FilterList)
+}
+
+type drainable interface {
+	Shutdown(ctx context.Context) (completed, abandoned int)
+	Wait()
+}
+
+type readinessReporter interface {
+	ConfigReloaded(err error)
+	ShuttingDown()
+}
+
+func watchConfig(c internal.Config, o adapter.Outbox, h reloadable, r readinessReporter, logger lager.Logger) {
+	l := logger.Session("reload-config")
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	var changes <-chan struct{}
+	w, err := internal.WatchConfig(configPath, logger)
+	if err != nil {
+		l.Error("watch", err)
+	} else {
+		defer w.Close()
+		changes = w.Changes()
+	}
+
+	for {
+		select {
+		case <-hup:
+			l.Info("signal")
+		case <-changes:
+			l.Info("file-changed")
+		}
+
+		n, err := internal.LoadConfig(configPath, logger)
+		r.ConfigReloaded(err)
+		if err != nil {
+			l.Error("keep-current-config", err)
+			continue
+		}
+		diff := c.Diff(n)
+		if len(diff) == 0 {
+			l.Info("unchanged")
+			continue
+		}
+		targets, err := adapter.NewTargets(n.Targets, o, logger)
+		r.ConfigReloaded(err)
+		if err != nil {
+			l.Error("keep-current-config", err)
+			continue
+		}
+		h.Reload(targets, n.Servers, n.Filter)
+		c = n
+		l.Info("reloaded", lager.Data{"changes": diff})
+		internal.LogWarnings(n, logger)
+	}
+}
+
+func newOutbox(c internal.Config, logger lager.Logger) (adapter.Outbox, error) {
+	initialBackoff, maxBackoff := c.Delivery.RetryBackoff()
+	return adapter.NewOutbox(filepath.Join(c.History.StoragePath, "outbox"), adapter.RetryPolicy{
+		MaxAttempts:    c.Delivery.MaxAttempts,
+		InitialBackoff: initialBackoff,
+		MaxBackoff:     maxBackoff,
+	}, logger)
+}
+
+func redriveDeadLetters(c internal.Config, logger lager.Logger) {
+	o, err := newOutbox(c, logger)
+	if err != nil {
+		logger.Fatal("outbox", err)
+	}
+	var names []string
+	for name := range c.Targets {
+		names = append(names, name)
+	}
+	count, err := o.Redrive(names)
+	if err != nil {
+		logger.Fatal("redrive-dead-letters", err)
+	}
+	logger.Info("redrive-dead-letters", lager.Data{"count": count})
+}
 
-	target := adapter.NewDiscordTarget(c.Discord.WebhookUrl, logger)
-	history, err := adapter.NewEventRepository(c.History.StoragePath)
+func serve(c internal.Config, logger lager.Logger) {
+	o, err := newOutbox(c, logger)
+	if err != nil {
+		logger.Fatal("outbox", err)
+	}
+	targets, err := adapter.NewTargets(c.Targets, o, logger)
+	if err != nil {
+		logger.Fatal("targets", err)
+	}
+	if err = o.Start(); err != nil {
+		logger.Fatal("outbox", err)
+	}
+	// logger.Fatal panics, so the pid file of the outbox is removed, when serve fails after the outbox started, too.
+	defer o.Stop()
+	// the state files are moved out of the history directory, before the compactor starts.
+	sessionsPath, err := adapter.StateFile(c.History.StoragePath, "sessions.json")
+	if err != nil {
+		logger.Fatal("session-tracker", err)
+	}
+	dedupPath := ""
+	if *c.Deduplication.Persist {
+		dedupPath, err = adapter.StateFile(c.History.StoragePath, "processed_events.jsonl")
+		if err != nil {
+			logger.Fatal("deduplicator", err)
+		}
+	}
+	history, err := newHistory(c)
 	if err != nil {
 		logger.Fatal("event-history", err)
 	}
-	h := handler.NewWebhookHandler(target, c.Servers, c.Filter, history, logger)
+	compactor := adapter.NewCompactor(history, historyCompactionInterval, logger)
+	deduplicator, err := adapter.NewDeduplicator(c.Deduplication.Duration(), dedupPath, logger)
+	if err != nil {
+		logger.Fatal("deduplicator", err)
+	}
+	sessions, err := adapter.NewSessionTracker(history, c.Sessions.StaleAfter(), sessionsPath, logger)
+	if err != nil {
+		logger.Fatal("session-tracker", err)
+	}
+	h := handler.NewWebhookHandler(targets, c.Servers, c.Filter, history, deduplicator, sessions, handler.Pipeline{
+		Workers:   c.Processing.Workers,
+		QueueSize: c.Processing.QueueSize,
+	}, time.Now, logger)
+	probes := handler.NewProbeHandler(c.History.StoragePath, o, logger)
+	go watchConfig(c, o, h, probes, logger)
+
+	registerMetrics(history, o, logger)
+
+	mux := http.NewServeMux()
+	mux.Handle("/", h)
+	adminMux := mux
+	var admin *http.Server
+	if c.AdminPort != 0 {
+		adminMux = http.NewServeMux()
+		admin = &http.Server{Addr: ":" + strconv.Itoa(c.AdminPort), Handler: adminMux}
+		go func() {
+			logger.Info("start-admin-listener", lager.Data{"port": c.AdminPort})
+			if err := admin.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				logger.Fatal("start-admin-listener", err)
+			}
+		}()
+	}
+	probes.Register(adminMux)
+	adminMux.Handle("/metrics", metrics.Handler())
+
+	server := &http.Server{Addr: ":" + strconv.Itoa(c.Port), Handler: mux}
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		shutdown(c, server, admin, h, o, probes, logger)
+		compactor.Stop()
+		if closer, ok := history.(io.Closer); ok {
+			if err := closer.Close(); err != nil {
+				logger.Error("close-history", err)
+			}
+		}
+		sessions.Stop()
+		deduplicator.Stop()
+	}()
 
 	logger.Info("start-listener", lager.Data{"port": c.Port})
-	err = http.ListenAndServe(":"+strconv.Itoa(c.Port), h)
-	if err != nil {
+	err = server.ListenAndServe()
+	if err != nil && err != http.ErrServerClosed {
 		logger.Fatal("start-listener", err)
 	}
+	<-stopped
+}
+
+type historyStore interface {
+	domain.EventHistory
+	adapter.Compactable
+	Size() (players int, bytes int64, err error)
+}
+
+func newHistory(c internal.Config) (historyStore, error) {
+	if c.History.Driver == internal.HistoryDriverSqlite {
+		return adapter.NewSqliteEventRepository(filepath.Join(c.History.StoragePath, historyDatabase), c.History.Retention())
+	}
+	return adapter.NewEventRepository(c.History.StoragePath, c.History.Retention())
+}
+
+func importHistory(c internal.Config, logger lager.Logger) {
+	from, err := adapter.NewEventRepository(c.History.StoragePath, c.History.Retention())
+	if err != nil {
+		logger.Fatal("import-history", err)
+	}
+	to, err := adapter.NewSqliteEventRepository(filepath.Join(c.History.StoragePath, historyDatabase), c.History.Retention())
+	if err != nil {
+		logger.Fatal("import-history", err)
+	}
+	defer to.Close()
+	count, err := to.Import(from)
+	if err != nil {
+		logger.Fatal("import-history", err)
+	}
+	logger.Info("import-history", lager.Data{"count": count})
+}
+
+func registerMetrics(history historyStore, o adapter.Outbox, logger lager.Logger) {
+	var (
+		lock      sync.Mutex
+		players   int
+		bytes     int64
+		updatedAt time.Time
+	)
+	historySize := func() (int, int64) {
+		lock.Lock()
+		defer lock.Unlock()
+		if time.Since(updatedAt) < historySizeMaxAge {
+			return players, bytes
+		}
+		p, b, err := history.Size()
+		if err != nil {
+			logger.Error("history-size", err)
+		}
+		players, bytes, updatedAt = p, b, time.Now()
+		return players, bytes
+	}
+	metrics.NewGaugeFunc("cftools_relay_history_players", "Players with events in the history.", func() float64 {
+		players, _ := historySize()
+		return float64(players)
+	})
+	metrics.NewGaugeFunc("cftools_relay_history_size_bytes", "Size of the history storage in bytes.", func() float64 {
+		_, bytes := historySize()
+		return float64(bytes)
+	})
+	metrics.NewGaugeFunc("cftools_relay_outbox_pending", "Messages waiting for being delivered.", func() float64 {
+		return float64(o.Pending())
+	})
+}
+
+// shutdown waits for SIGTERM or SIGINT and stops the server. Accepted events are processed and the outbox is flushed,
+// until the configured shutdown timeout is reached. The admin server, if any, is stopped last.
+func shutdown(c internal.Config, server, admin *http.Server, h drainable, o adapter.Outbox, r readinessReporter, logger lager.Logger) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	sig := <-signals
+
+	l := logger.Session("shutdown", lager.Data{"signal": sig.String(), "timeout": c.Shutdown.Timeout})
+	l.Info("start")
+	r.ShuttingDown()
+	ctx, cancel := context.WithTimeout(context.Background(), c.Shutdown.Duration())
+	defer cancel()
+
+	if err := server.Shutdown(ctx); err != nil {
+		l.Error("stop-listener", err)
+	}
+	completed, abandoned := h.Shutdown(ctx)
+	undelivered := o.Flush(ctx)
+	o.Stop()
+	// the events in progress are still processed after the deadline, the stores are closed afterwards only.
+	h.Wait()
+	if admin != nil {
+		if err := admin.Shutdown(ctx); err != nil {
+			l.Error("stop-admin-listener", err)
+		}
+	}
+	l.Info("done", lager.Data{"completed": completed, "abandoned": abandoned, "undelivered": undelivered})
 }
@@ -3,38 +3,74 @@ package handler
 import (
 	"cftools-relay/internal/domain"
 	"code.cloudfoundry.org/lager"
+	"context"
 	"errors"
-	"golang.org/x/sync/singleflight"
 	"net/http"
 	"strings"
-	"time"
+	"sync"
 )
 
 const cfToolsWebhookPrefix = "/cftools-webhook"
 
+type routing struct {
+	targets map[string]domain.Target
+	servers map[string]domain.Server
+	// filters are the filters, which apply to the events of each server.
+	filters map[string]domain.FilterList
+}
+
+func newRouting(t map[string]domain.Target, s map[string]domain.Server, filter domain.FilterList) routing {
+	filters := map[string]domain.FilterList{}
+	for id, server := range s {
+		filters[id] = server.Filters(filter)
+	}
+	return routing{
+		targets: t,
+		servers: s,
+		filters: filters,
+	}
+}
+
 type webhookHandler struct {
-	target         domain.Target
-	servers        map[string]domain.Server
-	filter         domain.FilterList
-	history        domain.EventHistory
-	logger         lager.Logger
-	eventGroup     singleflight.Group
-	executedEvents map[string]time.Time
+	lock         sync.RWMutex
+	routing      routing
+	history      domain.EventHistory
+	deduplicator domain.Deduplicator
+	sessions     domain.SessionTracker
+	clock        domain.Clock
+	logger       lager.Logger
+	pipeline     *pipeline
+	pendingLock  sync.Mutex
+	pending      map[string]bool
 }
 
-func NewWebhookHandler(t domain.Target, s map[string]domain.Server, filter domain.FilterList, h domain.EventHistory, logger lager.Logger) *webhookHandler {
-	handler := &webhookHandler{
-		target:         t,
-		servers:        s,
-		filter:         filter,
-		history:        h,
-		logger:         logger,
-		executedEvents: map[string]time.Time{},
+// NewWebhookHandler creates the handler of the webhook events. Received events are timestamped with the clock.
+func NewWebhookHandler(t map[string]domain.Target, s map[string]domain.Server, filter domain.FilterList, h domain.EventHistory, d domain.Deduplicator, st domain.SessionTracker, p Pipeline, clock domain.Clock, logger lager.Logger) *webhookHandler {
+	return &webhookHandler{
+		routing:      newRouting(t, s, filter),
+		history:      h,
+		deduplicator: d,
+		sessions:     st,
+		clock:        clock,
+		logger:       logger,
+		pipeline:     newPipeline(p),
+		pending:      map[string]bool{},
 	}
+}
+
+// Reload replaces the targets, servers and filters used for new events. Events, which are processed already, finish with
+// the previous configuration.
+func (h *webhookHandler) Reload(t map[string]domain.Target, s map[string]domain.Server, filter domain.FilterList) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
 
-	go handler.invalidator(1 * time.Minute)
+	h.routing = newRouting(t, s, filter)
+}
 
-	return handler
+func (h *webhookHandler) currentRouting() routing {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	return h.routing
 }
 
 func (h *webhookHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -46,20 +82,23 @@ func (h *webhookHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		}
 	}()
 
-	s, err := h.serverFromRequest(r)
+	rt := h.currentRouting()
+	id, s, err := h.serverFromRequest(rt, r)
 	if err != nil {
 		w.WriteHeader(404)
 		return
 	}
 
-	e, err := domain.WebhookFromRequest(r)
+	e, err := domain.WebhookFromRequest(r, h.clock)
 	if err != nil {
 		l.Error("parse-event", err)
 		w.WriteHeader(500)
 		return
 	}
 
+	e.Event.Server = id
 	l.Info("event", lager.Data{"event": e})
+	webhooksReceived.Inc(id, eventLabel(e.Event.Type))
 	if e.Event.Type == domain.EventVerification {
 		w.WriteHeader(204)
 		return
@@ -67,42 +106,105 @@ func (h *webhookHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	if !e.IsValidSignature(s.Secret) {
 		l.Error("handle-event", errors.New("signature mismatch"))
+		webhooksRejectedSignature.Inc(id, eventLabel(e.Event.Type))
 		w.WriteHeader(403)
 		return
 	}
+	webhooksVerified.Inc(id, eventLabel(e.Event.Type))
 
-	_, err, _ = h.eventGroup.Do(e.Id, func() (interface{}, error) {
-		if _, ok := h.executedEvents[e.Id]; ok {
-			l.Info("de-duplicated-event", lager.Data{"id": e.Id})
-			return nil, nil
-		}
+	processed, err := h.deduplicator.IsProcessed(e.Id)
+	if err != nil {
+		l.Error("handle-event", err)
+		w.WriteHeader(500)
+		return
+	}
+	if processed || !h.markPending(e.Id) {
+		l.Info("de-duplicated-event", lager.Data{"id": e.Id})
+		webhooksDeduplicated.Inc(id, eventLabel(e.Event.Type))
+		w.WriteHeader(202)
+		return
+	}
 
-		err := h.onEvent(e, s.Name)
-		h.executedEvents[e.Id] = time.Now()
+	if !h.pipeline.Enqueue(job{key: orderingKey(e), process: func() { h.process(rt, e, id, s) }}) {
+		h.clearPending(e.Id)
+		l.Error("handle-event", errors.New("queue is full"))
+		webhooksRejectedQueueFull.Inc(id, eventLabel(e.Event.Type))
+		w.WriteHeader(503)
+		return
+	}
+	w.WriteHeader(202)
+}
 
-		return nil, err
-	})
+// Shutdown stops accepting new events and waits until all accepted events are processed or ctx is done. The number of
+// completed and abandoned events is returned.
+func (h *webhookHandler) Shutdown(ctx context.Context) (completed, abandoned int) {
+	return h.pipeline.Close(ctx)
+}
 
-	if err != nil {
+// Wait waits until the events in progress, when Shutdown abandoned the remaining events, are processed. It must only be
+// called after Shutdown.
+func (h *webhookHandler) Wait() {
+	h.pipeline.Wait()
+}
+
+func (h *webhookHandler) process(rt routing, e domain.WebhookEvent, serverId string, s domain.Server) {
+	l := h.logger.Session("process", lager.Data{"id": e.Id})
+	defer h.clearPending(e.Id)
+
+	if err := h.onEvent(rt, e, serverId, s); err != nil {
 		l.Error("handle-event", err)
-		w.WriteHeader(500)
+		eventsFailed.Inc(serverId, eventLabel(e.Event.Type))
+		return
+	}
+	if err := h.deduplicator.MarkProcessed(e.Id); err != nil {
+		l.Error("mark-processed", err)
+	}
+}
+
+// markPending reports false, if an event with the same id is waiting for being processed already.
+func (h *webhookHandler) markPending(id string) bool {
+	h.pendingLock.Lock()
+	defer h.pendingLock.Unlock()
+	if h.pending[id] {
+		return false
 	}
+	h.pending[id] = true
+	return true
+}
+
+func (h *webhookHandler) clearPending(id string) {
+	h.pendingLock.Lock()
+	defer h.pendingLock.Unlock()
+	delete(h.pending, id)
 }
 
-func (h *webhookHandler) onEvent(e domain.WebhookEvent, serverName *string) error {
+// orderingKey returns the key, which keeps events of the same player in order. Events without a player are ordered by
+// their own id only.
+func orderingKey(e domain.WebhookEvent) string {
+	if id := e.Event.CFToolsId(); id != nil {
+		return *id
+	}
+	return e.Id
+}
+
+func (h *webhookHandler) onEvent(rt routing, e domain.WebhookEvent, serverId string, s domain.Server) error {
 	if err := h.history.Save(e.Event); err != nil {
 		return err
 	}
+	if err := h.sessions.Track(e.Event); err != nil {
+		return err
+	}
 
-	m, f, err := h.filter.MatchingFilters(h.history, e.Event)
+	m, matches, err := rt.filters[serverId].Matching(h.history, e.Event)
 	if err != nil {
 		return err
 	}
-	if m && len(f) == 0 {
-		return h.target.Relay(e.Event, nil, serverName)
+	if m && len(matches) == 0 {
+		return h.relay(rt, e.Event, nil, s)
 	} else if m {
-		for _, filter := range f {
-			err = h.target.Relay(e.Event, &filter, serverName)
+		for _, match := range matches {
+			filterMatches.Inc(match.Filter.Label())
+			err = h.relay(rt, match.Event, &match.Filter, s)
 			if err != nil {
 				return err
 			}
@@ -111,47 +213,36 @@ func (h *webhookHandler) onEvent(e domain.WebhookEvent, serverName *string) erro
 	return nil
 }
 
-func (h *webhookHandler) serverFromRequest(r *http.Request) (domain.Server, error) {
+func (h *webhookHandler) relay(rt routing, e domain.Event, f *domain.Filter, s domain.Server) error {
+	e = e.WithoutSessionFields(f.SessionFields())
+	for _, name := range s.TargetNames(f) {
+		t, ok := rt.targets[name]
+		if !ok {
+			h.logger.Error("relay", errors.New("unknown target"), lager.Data{"target": name})
+			continue
+		}
+		if err := t.Relay(e, f, s.Name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// serverFromRequest returns the id of the server, which is the key in the servers config, and the server itself.
+func (h *webhookHandler) serverFromRequest(rt routing, r *http.Request) (string, domain.Server, error) {
 	l := h.logger.Session("server-from-request", lager.Data{"url": r.URL.String()})
 
 	if !strings.HasPrefix(r.URL.String(), cfToolsWebhookPrefix) {
 		l.Debug("not-found", lager.Data{"path": r.URL.String()})
-		return domain.Server{}, errors.New("not a webhook event")
+		return "", domain.Server{}, errors.New("not a webhook event")
 	}
 
 	parts := strings.Split(strings.TrimPrefix(r.URL.String(), cfToolsWebhookPrefix), "/")
 	sn := parts[len(parts)-1]
-	s, ok := h.servers[sn]
+	s, ok := rt.servers[sn]
 	if !ok {
 		l.Debug("not-found", lager.Data{"path": r.URL.String(), "serverName": sn})
-		return domain.Server{}, errors.New("not a known server")
-	}
-	return s, nil
-}
-
-func (h *webhookHandler) invalidator(ttl time.Duration) {
-	t := time.NewTicker(ttl)
-	defer t.Stop()
-
-	for range t.C {
-		func() {
-			defer func() {
-				if err := recover(); err != nil {
-					h.logger.Error("invalidator-recover", nil, lager.Data{"panic": err})
-				}
-			}()
-
-			count := 0
-			expired := time.Now().Add(2 * time.Minute)
-			for k, v := range h.executedEvents {
-				if v.Before(expired) {
-					delete(h.executedEvents, k)
-					count++
-				}
-			}
-			if count != 0 {
-				h.logger.Info("expire-executed-events", lager.Data{"invalidated": count, "remaining": len(h.executedEvents)})
-			}
-		}()
+		return "", domain.Server{}, errors.New("not a known server")
 	}
+	return sn, s, nil
 }
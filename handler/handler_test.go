@@ -0,0 +1,216 @@
+package handler
+
+import (
+	"cftools-relay/internal/domain"
+	"code.cloudfoundry.org/lager"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+type recordingTarget struct {
+	lock    sync.Mutex
+	relayed []string
+	values  []map[string]interface{}
+}
+
+func (t *recordingTarget) Relay(e domain.Event, f *domain.Filter, _ *string) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	label := "none"
+	if f != nil {
+		label = f.Label()
+	}
+	t.relayed = append(t.relayed, e.Type+":"+label)
+	t.values = append(t.values, e.Values)
+	return nil
+}
+
+type noHistory struct{}
+
+func (noHistory) Save(domain.Event) error {
+	return nil
+}
+
+func (noHistory) FindWithin(*string, string, string, time.Duration) ([]domain.Event, error) {
+	return nil, nil
+}
+
+type failingHistory struct {
+	noHistory
+}
+
+func (failingHistory) Save(domain.Event) error {
+	return errors.New("disk full")
+}
+
+type noSessions struct{}
+
+func (noSessions) Track(e domain.Event) error {
+	e.Values[domain.VirtualFieldOnlineCount] = 1
+	e.Values[domain.VirtualFieldSessionsToday] = 1
+	return nil
+}
+
+type noDeduplication struct{}
+
+func (noDeduplication) IsProcessed(string) (bool, error) {
+	return false, nil
+}
+
+func (noDeduplication) MarkProcessed(string) error {
+	return nil
+}
+
+var _ = Describe("webhookHandler", func() {
+	var (
+		defaultTarget, pvpTarget *recordingTarget
+		h                        *webhookHandler
+		now                      time.Time
+	)
+
+	BeforeEach(func() {
+		defaultTarget, pvpTarget = &recordingTarget{}, &recordingTarget{}
+		global := domain.FilterList{{Event: domain.EventUserJoin}}
+		servers := map[string]domain.Server{
+			"pve": {},
+			"pvp": {
+				Targets: []string{"pvp"},
+				Filter:  domain.FilterList{{Name: "kills", Event: domain.EventPlayerKill}},
+			},
+			"event": {
+				IgnoreGlobalFilter: true,
+				Filter:             domain.FilterList{{Name: "chat", Event: domain.EventUserChat}},
+			},
+		}
+		Expect(global.Compile()).To(Succeed())
+		h = NewWebhookHandler(map[string]domain.Target{
+			domain.DefaultTarget: defaultTarget,
+			"pvp":                pvpTarget,
+		}, servers, global, noHistory{}, noDeduplication{}, noSessions{}, Pipeline{Workers: 1, QueueSize: 1}, func() time.Time {
+			return now
+		}, lager.NewLogger("test"))
+	})
+
+	relay := func(serverId, eventType string) {
+		rt := h.currentRouting()
+		e := domain.WebhookEvent{Event: domain.Event{Type: eventType, Values: map[string]interface{}{domain.FieldCfToolsId: "A_PLAYER"}}}
+		Expect(h.onEvent(rt, e, serverId, rt.servers[serverId])).To(Succeed())
+	}
+
+	It("applies the global filters to servers without own filters", func() {
+		relay("pve", domain.EventUserJoin)
+		relay("pve", domain.EventPlayerKill)
+
+		Expect(defaultTarget.relayed).To(Equal([]string{"user.join:filter[0]"}))
+		Expect(pvpTarget.relayed).To(BeEmpty())
+	})
+
+	It("applies the own filters of a server and relays to its targets", func() {
+		relay("pvp", domain.EventUserJoin)
+		relay("pvp", domain.EventPlayerKill)
+
+		Expect(defaultTarget.relayed).To(BeEmpty())
+		Expect(pvpTarget.relayed).To(Equal([]string{"user.join:filter[0]", "player.kill:kills"}))
+	})
+
+	It("ignores the global filters when the server opted out", func() {
+		relay("event", domain.EventUserJoin)
+		relay("event", domain.EventUserChat)
+
+		Expect(defaultTarget.relayed).To(Equal([]string{"user.chat:chat"}))
+	})
+
+	It("relays only the session virtual fields, which the filter uses", func() {
+		online := domain.FilterList{{Event: domain.EventUserJoin, Rules: domain.RuleList{{Comparator: domain.ComparatorGreaterThanOrEqual, Field: domain.VirtualFieldOnlineCount, Value: 1}}}}
+		Expect(online.Compile()).To(Succeed())
+		rt := h.currentRouting()
+		rt.filters["online"] = online
+		rt.filters["all"] = domain.FilterList{}
+		rt.servers["all"] = domain.Server{}
+
+		for _, serverId := range []string{"online", "all"} {
+			e := domain.WebhookEvent{Event: domain.Event{Type: domain.EventUserJoin, Values: map[string]interface{}{domain.FieldCfToolsId: "A_PLAYER"}}}
+			Expect(h.onEvent(rt, e, serverId, rt.servers[serverId])).To(Succeed())
+		}
+
+		Expect(defaultTarget.values).To(HaveLen(2))
+		Expect(defaultTarget.values[0]).To(HaveKey(domain.VirtualFieldOnlineCount))
+		Expect(defaultTarget.values[0]).ToNot(HaveKey(domain.VirtualFieldSessionsToday))
+		Expect(defaultTarget.values[1]).ToNot(HaveKey(domain.VirtualFieldOnlineCount))
+		Expect(defaultTarget.values[1]).To(HaveKey(domain.FieldCfToolsId))
+	})
+
+	It("relays events received within the schedule of a filter only", func() {
+		berlin, err := time.LoadLocation("Europe/Berlin")
+		Expect(err).ToNot(HaveOccurred())
+		night := domain.FilterList{{Event: domain.EventUserJoin, Schedule: &domain.Schedule{
+			TimeZone: "Europe/Berlin",
+			Times:    []domain.TimeRange{{From: "02:00", To: "06:00"}},
+		}}}
+		Expect(night.Compile()).To(Succeed())
+		h = NewWebhookHandler(map[string]domain.Target{domain.DefaultTarget: defaultTarget}, map[string]domain.Server{
+			"night": {Filter: night},
+		}, domain.FilterList{}, noHistory{}, noDeduplication{}, noSessions{}, Pipeline{Workers: 1, QueueSize: 3}, func() time.Time {
+			return now
+		}, lager.NewLogger("test"))
+
+		for _, delivery := range []struct {
+			id string
+			at time.Time
+		}{
+			{"before", time.Date(2021, 12, 3, 1, 59, 0, 0, berlin)},
+			{"within", time.Date(2021, 12, 3, 2, 30, 0, 0, berlin)},
+			{"after", time.Date(2021, 12, 3, 6, 0, 0, 0, berlin)},
+		} {
+			now = delivery.at
+			signature := sha256.Sum256([]byte(delivery.id))
+			r := httptest.NewRequest("POST", cfToolsWebhookPrefix+"/night", strings.NewReader(`{"cftools_id":"A_PLAYER"}`))
+			r.Header.Set("X-Hephaistos-Shard", "0")
+			r.Header.Set("X-Hephaistos-Event", domain.EventUserJoin)
+			r.Header.Set("X-Hephaistos-Delivery", delivery.id)
+			r.Header.Set("X-Hephaistos-Signature", hex.EncodeToString(signature[:]))
+			w := httptest.NewRecorder()
+
+			h.ServeHTTP(w, r)
+
+			Expect(w.Code).To(BeNumerically("<", 300))
+		}
+		_, abandoned := h.Shutdown(context.Background())
+
+		Expect(abandoned).To(BeZero())
+		Expect(defaultTarget.relayed).To(Equal([]string{"user.join:filter[0]"}))
+	})
+
+	It("counts events, which could not be processed", func() {
+		rt := h.currentRouting()
+		h.history = failingHistory{}
+		e := domain.WebhookEvent{Id: "failing", Event: domain.Event{Type: domain.EventUserJoin, Values: map[string]interface{}{domain.FieldCfToolsId: "A_PLAYER"}}}
+		before := eventsFailed.Value("pve", domain.EventUserJoin)
+
+		h.process(rt, e, "pve", rt.servers["pve"])
+
+		Expect(eventsFailed.Value("pve", domain.EventUserJoin)).To(Equal(before + 1))
+		Expect(defaultTarget.relayed).To(BeEmpty())
+	})
+
+	It("counts events of unknown types as unknown", func() {
+		r := httptest.NewRequest("POST", cfToolsWebhookPrefix+"/pvp", strings.NewReader(`{}`))
+		r.Header.Set("X-Hephaistos-Shard", "0")
+		r.Header.Set("X-Hephaistos-Event", "made.up")
+		before := webhooksRejectedSignature.Value("pvp", "unknown")
+
+		h.ServeHTTP(httptest.NewRecorder(), r)
+
+		Expect(webhooksRejectedSignature.Value("pvp", "unknown")).To(Equal(before + 1))
+		Expect(webhooksReceived.Value("pvp", "made.up")).To(BeZero())
+	})
+})
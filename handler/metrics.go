@@ -0,0 +1,25 @@
+package handler
+
+import (
+	"cftools-relay/internal/domain"
+	"cftools-relay/internal/metrics"
+)
+
+var (
+	webhooksReceived          = metrics.NewCounterVec("cftools_relay_webhooks_received_total", "Webhook events received from CFTools.", "server", "event")
+	webhooksVerified          = metrics.NewCounterVec("cftools_relay_webhooks_verified_total", "Webhook events with a valid signature.", "server", "event")
+	webhooksRejectedSignature = metrics.NewCounterVec("cftools_relay_webhooks_rejected_signature_total", "Webhook events rejected because of an invalid signature.", "server", "event")
+	webhooksDeduplicated      = metrics.NewCounterVec("cftools_relay_webhooks_deduplicated_total", "Webhook events ignored, because they were received already.", "server", "event")
+	webhooksRejectedQueueFull = metrics.NewCounterVec("cftools_relay_webhooks_rejected_queue_full_total", "Webhook events rejected, because the processing queue was full.", "server", "event")
+	eventsFailed              = metrics.NewCounterVec("cftools_relay_events_failed_total", "Accepted webhook events, which could not be processed and were dropped.", "server", "event")
+	filterMatches             = metrics.NewCounterVec("cftools_relay_filter_matches_total", "Events matched by a filter.", "filter")
+)
+
+// eventLabel returns the event type as a label value. The type is taken from a header, before the signature is checked,
+// so unknown types are counted as unknown to limit the number of series.
+func eventLabel(t string) string {
+	if domain.IsEventType(t) {
+		return t
+	}
+	return "unknown"
+}
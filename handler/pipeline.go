@@ -0,0 +1,122 @@
+package handler
+
+import (
+	"context"
+	"hash/fnv"
+	"sync"
+	"sync/atomic"
+)
+
+// Pipeline configures the asynchronous processing of webhook events.
+type Pipeline struct {
+	Workers   int
+	QueueSize int
+}
+
+type job struct {
+	key     string
+	process func()
+}
+
+// pipeline processes jobs with a fixed number of workers. Jobs with the same key are always processed by the same
+// worker, one after another, in the order they were enqueued. The queue size limits the jobs waiting for any worker,
+// so a single busy worker can use the whole queue.
+type pipeline struct {
+	lock    sync.RWMutex
+	closed  bool
+	queues  []chan job
+	size    int64
+	workers sync.WaitGroup
+	// queued is the number of enqueued jobs, which no worker started to process yet.
+	queued int64
+	// pending is the number of enqueued jobs, which are not processed yet.
+	pending   int64
+	abandoned int32
+}
+
+func newPipeline(c Pipeline) *pipeline {
+	workers := c.Workers
+	if workers < 1 {
+		workers = 1
+	}
+	size := c.QueueSize
+	if size < 1 {
+		size = 1
+	}
+	p := &pipeline{queues: make([]chan job, workers), size: int64(size)}
+	for i := range p.queues {
+		p.queues[i] = make(chan job, size)
+		p.workers.Add(1)
+		go p.work(p.queues[i])
+	}
+	return p
+}
+
+// Enqueue schedules the job for processing and reports false, if the queue is full or the pipeline is closed already.
+func (p *pipeline) Enqueue(j job) bool {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	if p.closed {
+		return false
+	}
+
+	if atomic.AddInt64(&p.queued, 1) > p.size {
+		atomic.AddInt64(&p.queued, -1)
+		return false
+	}
+	atomic.AddInt64(&p.pending, 1)
+	// each worker can hold the whole queue, so this never blocks.
+	p.queues[p.shard(j.key)] <- j
+	return true
+}
+
+// Close stops accepting new jobs and waits until all enqueued jobs are processed or ctx is done. Jobs, which are not
+// processed when ctx is done, are abandoned. The number of completed and abandoned jobs is returned.
+func (p *pipeline) Close(ctx context.Context) (completed, abandoned int) {
+	p.lock.Lock()
+	if !p.closed {
+		p.closed = true
+		for _, q := range p.queues {
+			close(q)
+		}
+	}
+	p.lock.Unlock()
+
+	pending := int(atomic.LoadInt64(&p.pending))
+	done := make(chan struct{})
+	go func() {
+		p.workers.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return pending, 0
+	case <-ctx.Done():
+		atomic.StoreInt32(&p.abandoned, 1)
+		abandoned = int(atomic.LoadInt64(&p.pending))
+		return pending - abandoned, abandoned
+	}
+}
+
+// Wait waits until the workers exited, i.e. until the job in progress, when Close abandoned the remaining jobs, is
+// done. It must only be called after Close.
+func (p *pipeline) Wait() {
+	p.workers.Wait()
+}
+
+func (p *pipeline) shard(key string) int {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(key))
+	return int(h.Sum32() % uint32(len(p.queues)))
+}
+
+func (p *pipeline) work(q <-chan job) {
+	defer p.workers.Done()
+	for j := range q {
+		atomic.AddInt64(&p.queued, -1)
+		if atomic.LoadInt32(&p.abandoned) == 0 {
+			j.process()
+		}
+		atomic.AddInt64(&p.pending, -1)
+	}
+}
@@ -0,0 +1,119 @@
+package handler
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("pipeline", func() {
+	It("processes jobs with the same key in order", func() {
+		p := newPipeline(Pipeline{Workers: 4, QueueSize: 400})
+		var lock sync.Mutex
+		processed := map[string][]int{}
+		for i := 0; i < 50; i++ {
+			for _, key := range []string{"A", "B", "C"} {
+				i, key := i, key
+				Expect(p.Enqueue(job{key: key, process: func() {
+					lock.Lock()
+					defer lock.Unlock()
+					processed[key] = append(processed[key], i)
+				}})).To(BeTrue())
+			}
+		}
+		completed, abandoned := p.Close(context.Background())
+		Expect(completed).To(Equal(150))
+		Expect(abandoned).To(Equal(0))
+
+		for _, key := range []string{"A", "B", "C"} {
+			Expect(processed[key]).To(HaveLen(50))
+			for i, v := range processed[key] {
+				Expect(v).To(Equal(i), "job %d of %s", i, key)
+			}
+		}
+	})
+
+	It("rejects jobs when the queue is full", func() {
+		p := newPipeline(Pipeline{Workers: 1, QueueSize: 2})
+		block := make(chan struct{})
+		started := make(chan struct{})
+		Expect(p.Enqueue(job{key: "A", process: func() {
+			close(started)
+			<-block
+		}})).To(BeTrue())
+		<-started
+
+		accepted := 0
+		for i := 0; i < 5; i++ {
+			if p.Enqueue(job{key: strconv.Itoa(i), process: func() {}}) {
+				accepted++
+			}
+		}
+		Expect(accepted).To(Equal(2))
+
+		close(block)
+		p.Close(context.Background())
+		Expect(p.Enqueue(job{key: "A", process: func() {}})).To(BeFalse())
+	})
+
+	It("lets the jobs of a single worker use the whole queue", func() {
+		p := newPipeline(Pipeline{Workers: 4, QueueSize: 4})
+		block := make(chan struct{})
+		started := make(chan struct{})
+		Expect(p.Enqueue(job{key: "A", process: func() {
+			close(started)
+			<-block
+		}})).To(BeTrue())
+		<-started
+
+		for i := 0; i < 4; i++ {
+			Expect(p.Enqueue(job{key: "A", process: func() {}})).To(BeTrue(), "job %d", i)
+		}
+		Expect(p.Enqueue(job{key: "B", process: func() {}})).To(BeFalse())
+
+		close(block)
+		completed, _ := p.Close(context.Background())
+		Expect(completed).To(Equal(5))
+	})
+
+	It("abandons jobs, which are not processed until the deadline", func() {
+		p := newPipeline(Pipeline{Workers: 1, QueueSize: 10})
+		block := make(chan struct{})
+		defer close(block)
+		processed := int32(0)
+		Expect(p.Enqueue(job{key: "A", process: func() { <-block }})).To(BeTrue())
+		for i := 0; i < 3; i++ {
+			Expect(p.Enqueue(job{key: "A", process: func() { atomic.AddInt32(&processed, 1) }})).To(BeTrue())
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		completed, abandoned := p.Close(ctx)
+		Expect(completed).To(Equal(0))
+		Expect(abandoned).To(Equal(4))
+		Consistently(func() int32 { return atomic.LoadInt32(&processed) }, 100*time.Millisecond).Should(BeZero())
+	})
+
+	It("waits for the job in progress, when jobs were abandoned", func() {
+		p := newPipeline(Pipeline{Workers: 1, QueueSize: 10})
+		block := make(chan struct{})
+		Expect(p.Enqueue(job{key: "A", process: func() { <-block }})).To(BeTrue())
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		p.Close(ctx)
+
+		waited := make(chan struct{})
+		go func() {
+			p.Wait()
+			close(waited)
+		}()
+		Consistently(waited, 50*time.Millisecond).ShouldNot(BeClosed())
+		close(block)
+		Eventually(waited).Should(BeClosed())
+	})
+})
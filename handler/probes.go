@@ -0,0 +1,144 @@
+package handler
+
+import (
+	"cftools-relay/internal/domain"
+	"code.cloudfoundry.org/lager"
+	"encoding/json"
+	"net/http"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"sync"
+)
+
+type DeliveryStatusProvider interface {
+	Status() map[string]domain.DeliveryStatus
+}
+
+type check struct {
+	Ok    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+type targetStatus struct {
+	Healthy bool `json:"healthy"`
+	domain.DeliveryStatus
+}
+
+type readiness struct {
+	Ready   bool                    `json:"ready"`
+	Checks  map[string]check        `json:"checks"`
+	Targets map[string]targetStatus `json:"targets"`
+}
+
+type version struct {
+	Version   string `json:"version"`
+	Sum       string `json:"sum,omitempty"`
+	GoVersion string `json:"go_version"`
+}
+
+type probeHandler struct {
+	lock         sync.RWMutex
+	storagePath  string
+	deliveries   DeliveryStatusProvider
+	configError  error
+	shuttingDown bool
+	logger       lager.Logger
+}
+
+func NewProbeHandler(storagePath string, d DeliveryStatusProvider, logger lager.Logger) *probeHandler {
+	return &probeHandler{
+		storagePath: storagePath,
+		deliveries:  d,
+		logger:      logger.Session("probes"),
+	}
+}
+
+// Register adds the /healthz, /readyz and /version endpoints to mux.
+func (p *probeHandler) Register(mux *http.ServeMux) {
+	mux.HandleFunc("/healthz", p.healthz)
+	mux.HandleFunc("/readyz", p.readyz)
+	mux.HandleFunc("/version", p.version)
+}
+
+// ConfigReloaded records the result of the most recent reload of the config. A failed reload does not make the relay
+// unready, as the previous config is still used.
+func (p *probeHandler) ConfigReloaded(err error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.configError = err
+}
+
+// ShuttingDown makes the relay unready, so that no new events are sent to it.
+func (p *probeHandler) ShuttingDown() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.shuttingDown = true
+}
+
+func (p *probeHandler) healthz(w http.ResponseWriter, _ *http.Request) {
+	p.write(w, 200, check{Ok: true})
+}
+
+func (p *probeHandler) readyz(w http.ResponseWriter, _ *http.Request) {
+	p.lock.RLock()
+	configError, shuttingDown := p.configError, p.shuttingDown
+	p.lock.RUnlock()
+
+	r := readiness{
+		Checks: map[string]check{
+			"config":  {Ok: true},
+			"storage": p.checkStorage(),
+			"running": {Ok: !shuttingDown},
+		},
+		Targets: map[string]targetStatus{},
+	}
+	for name, s := range p.deliveries.Status() {
+		r.Targets[name] = targetStatus{Healthy: s.Healthy(), DeliveryStatus: s}
+	}
+	if configError != nil {
+		r.Checks["config"] = check{Ok: true, Error: "last reload failed, using the previous config: " + configError.Error()}
+	}
+	if shuttingDown {
+		r.Checks["running"] = check{Error: "shutting down"}
+	}
+
+	r.Ready = true
+	for _, c := range r.Checks {
+		r.Ready = r.Ready && c.Ok
+	}
+	status := 200
+	if !r.Ready {
+		status = 503
+	}
+	p.write(w, status, r)
+}
+
+func (p *probeHandler) checkStorage() check {
+	f, err := os.CreateTemp(p.storagePath, ".readyz-*")
+	if err != nil {
+		return check{Error: err.Error()}
+	}
+	_ = f.Close()
+	if err := os.Remove(f.Name()); err != nil {
+		return check{Error: err.Error()}
+	}
+	return check{Ok: true}
+}
+
+func (p *probeHandler) version(w http.ResponseWriter, _ *http.Request) {
+	v := version{Version: "unknown", GoVersion: runtime.Version()}
+	if info, ok := debug.ReadBuildInfo(); ok {
+		v.Version = info.Main.Version
+		v.Sum = info.Main.Sum
+	}
+	p.write(w, 200, v)
+}
+
+func (p *probeHandler) write(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		p.logger.Error("write-response", err)
+	}
+}
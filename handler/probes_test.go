@@ -0,0 +1,97 @@
+package handler
+
+import (
+	"cftools-relay/internal/domain"
+	"code.cloudfoundry.org/lager"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+type staticDeliveryStatus map[string]domain.DeliveryStatus
+
+func (s staticDeliveryStatus) Status() map[string]domain.DeliveryStatus {
+	return s
+}
+
+var _ = Describe("probeHandler", func() {
+	var (
+		storagePath string
+		probes      *probeHandler
+		mux         *http.ServeMux
+	)
+
+	BeforeEach(func() {
+		path, err := os.MkdirTemp("", "test-probes")
+		Expect(err).ToNot(HaveOccurred())
+		storagePath = path
+		failed := time.Now()
+		probes = NewProbeHandler(storagePath, staticDeliveryStatus{
+			"default": {Pending: 2, LastFailure: &failed, LastError: "503 Service Unavailable"},
+		}, lager.NewLogger("test"))
+		mux = http.NewServeMux()
+		probes.Register(mux)
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(storagePath)).To(Succeed())
+	})
+
+	get := func(path string, body interface{}) int {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		if body != nil {
+			Expect(json.Unmarshal(w.Body.Bytes(), body)).To(Succeed())
+		}
+		return w.Code
+	}
+
+	It("reports a live process", func() {
+		Expect(get("/healthz", nil)).To(Equal(200))
+	})
+
+	It("reports readiness with the status of each target", func() {
+		var r readiness
+		Expect(get("/readyz", &r)).To(Equal(200))
+		Expect(r.Ready).To(BeTrue())
+		Expect(r.Targets["default"].Healthy).To(BeFalse())
+		Expect(r.Targets["default"].Pending).To(Equal(2))
+		Expect(r.Targets["default"].LastError).To(Equal("503 Service Unavailable"))
+	})
+
+	It("stays ready when a config reload failed", func() {
+		probes.ConfigReloaded(errors.New("invalid config"))
+
+		var r readiness
+		Expect(get("/readyz", &r)).To(Equal(200))
+		Expect(r.Checks["config"].Error).To(ContainSubstring("invalid config"))
+	})
+
+	It("is not ready when the storage is not writable", func() {
+		probes.storagePath = filepath.Join(storagePath, "missing")
+
+		var r readiness
+		Expect(get("/readyz", &r)).To(Equal(503))
+		Expect(r.Checks["storage"].Ok).To(BeFalse())
+	})
+
+	It("is not ready when shutting down", func() {
+		probes.ShuttingDown()
+
+		Expect(get("/readyz", nil)).To(Equal(503))
+	})
+
+	It("reports the version", func() {
+		var v version
+		Expect(get("/version", &v)).To(Equal(200))
+		Expect(v.GoVersion).ToNot(BeEmpty())
+		Expect(v.Version).ToNot(BeEmpty())
+	})
+})
@@ -0,0 +1,55 @@
+package adapter
+
+import (
+	"code.cloudfoundry.org/lager"
+	"time"
+)
+
+type Compactable interface {
+	Compact() (int, error)
+}
+
+type compactor struct {
+	history Compactable
+	logger  lager.Logger
+	stop    chan struct{}
+}
+
+// NewCompactor compacts the history right away and then every interval, until it is stopped.
+func NewCompactor(h Compactable, interval time.Duration, logger lager.Logger) *compactor {
+	c := &compactor{
+		history: h,
+		logger:  logger.Session("compactor"),
+		stop:    make(chan struct{}),
+	}
+	go c.compactEvery(interval)
+	return c
+}
+
+func (c *compactor) Stop() {
+	close(c.stop)
+}
+
+func (c *compactor) compactEvery(interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		c.compact()
+		select {
+		case <-t.C:
+		case <-c.stop:
+			return
+		}
+	}
+}
+
+func (c *compactor) compact() {
+	started := time.Now()
+	removed, err := c.history.Compact()
+	if err != nil {
+		c.logger.Error("compact", err, lager.Data{"removed": removed})
+		return
+	}
+	c.logger.Info("compacted", lager.Data{"removed": removed, "duration": time.Since(started).String()})
+}
@@ -0,0 +1,158 @@
+package adapter
+
+import (
+	"bufio"
+	"bytes"
+	"code.cloudfoundry.org/lager"
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+)
+
+type processedEvent struct {
+	Id          string    `json:"id"`
+	ProcessedAt time.Time `json:"processed_at"`
+}
+
+type deduplicator struct {
+	ttl    time.Duration
+	path   string
+	logger lager.Logger
+	lock   sync.RWMutex
+	events map[string]time.Time
+	stop   chan struct{}
+}
+
+// NewDeduplicator creates a deduplicator that forgets processed IDs after ttl. If path is not empty, processed IDs are
+// written to this file as well, so that they are still known after a restart.
+func NewDeduplicator(ttl time.Duration, path string, logger lager.Logger) (*deduplicator, error) {
+	d := &deduplicator{
+		ttl:    ttl,
+		path:   path,
+		logger: logger.Session("deduplicator"),
+		events: map[string]time.Time{},
+		stop:   make(chan struct{}),
+	}
+	if path != "" {
+		if err := d.load(); err != nil {
+			return nil, err
+		}
+	}
+
+	interval := time.Minute
+	if ttl > 0 && ttl < interval {
+		interval = ttl
+	}
+	go d.expireEvery(interval)
+	return d, nil
+}
+
+func (d *deduplicator) IsProcessed(id string) (bool, error) {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+
+	t, ok := d.events[id]
+	return ok && time.Since(t) < d.ttl, nil
+}
+
+func (d *deduplicator) MarkProcessed(id string) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	now := time.Now()
+	d.events[id] = now
+	if d.path == "" {
+		return nil
+	}
+	c, err := json.Marshal(processedEvent{Id: id, ProcessedAt: now})
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(d.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(append(c, '\n')); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func (d *deduplicator) Stop() {
+	close(d.stop)
+}
+
+func (d *deduplicator) expireEvery(interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-t.C:
+			if err := d.expire(); err != nil {
+				d.logger.Error("expire", err)
+			}
+		case <-d.stop:
+			return
+		}
+	}
+}
+
+func (d *deduplicator) expire() error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	count := 0
+	expired := time.Now().Add(-d.ttl)
+	for id, t := range d.events {
+		if t.Before(expired) {
+			delete(d.events, id)
+			count++
+		}
+	}
+	if count == 0 {
+		return nil
+	}
+	d.logger.Info("expire-processed-events", lager.Data{"invalidated": count, "remaining": len(d.events)})
+	if d.path == "" {
+		return nil
+	}
+	var b bytes.Buffer
+	for id, t := range d.events {
+		c, err := json.Marshal(processedEvent{Id: id, ProcessedAt: t})
+		if err != nil {
+			return err
+		}
+		b.Write(c)
+		b.WriteByte('\n')
+	}
+	if err := os.WriteFile(d.path+".tmp", b.Bytes(), 0600); err != nil {
+		return err
+	}
+	return os.Rename(d.path+".tmp", d.path)
+}
+
+func (d *deduplicator) load() error {
+	c, err := os.ReadFile(d.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	expired := time.Now().Add(-d.ttl)
+	s := bufio.NewScanner(bytes.NewReader(c))
+	for s.Scan() {
+		var e processedEvent
+		if err := json.Unmarshal(s.Bytes(), &e); err != nil {
+			d.logger.Error("skip-invalid-entry", err)
+			continue
+		}
+		if e.ProcessedAt.After(expired) {
+			d.events[e.Id] = e.ProcessedAt
+		}
+	}
+	return s.Err()
+}
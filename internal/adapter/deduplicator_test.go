@@ -0,0 +1,103 @@
+package adapter_test
+
+import (
+	"cftools-relay/internal/adapter"
+	"code.cloudfoundry.org/lager"
+	"fmt"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+var _ = Describe("Deduplicator", func() {
+	var tmpPath string
+
+	BeforeEach(func() {
+		path, err := os.MkdirTemp("", "test-dedup")
+		if err != nil {
+			panic(err)
+		}
+		tmpPath = path
+	})
+
+	AfterEach(func() {
+		err := os.RemoveAll(tmpPath)
+		if err != nil {
+			panic(err)
+		}
+	})
+
+	It("does not panic without a positive ttl", func() {
+		d, err := adapter.NewDeduplicator(0, "", lager.NewLogger("test"))
+		Expect(err).ToNot(HaveOccurred())
+		defer d.Stop()
+
+		Expect(d.MarkProcessed("AN_ID")).To(Succeed())
+		Expect(d.IsProcessed("AN_ID")).To(BeFalse())
+	})
+
+	It("recognises processed IDs", func() {
+		d, err := adapter.NewDeduplicator(1*time.Hour, "", lager.NewLogger("test"))
+		Expect(err).ToNot(HaveOccurred())
+		defer d.Stop()
+
+		Expect(d.MarkProcessed("AN_ID")).To(Succeed())
+
+		Expect(d.IsProcessed("AN_ID")).To(BeTrue())
+		Expect(d.IsProcessed("ANOTHER_ID")).To(BeFalse())
+	})
+
+	It("forgets IDs after the TTL", func() {
+		d, err := adapter.NewDeduplicator(50*time.Millisecond, "", lager.NewLogger("test"))
+		Expect(err).ToNot(HaveOccurred())
+		defer d.Stop()
+
+		Expect(d.MarkProcessed("AN_ID")).To(Succeed())
+
+		Expect(d.IsProcessed("AN_ID")).To(BeTrue())
+		Eventually(func() bool {
+			p, _ := d.IsProcessed("AN_ID")
+			return p
+		}).Should(BeFalse())
+	})
+
+	It("remembers IDs across restarts when persisted", func() {
+		path := filepath.Join(tmpPath, "processed_events.jsonl")
+		d, err := adapter.NewDeduplicator(1*time.Hour, path, lager.NewLogger("test"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(d.MarkProcessed("AN_ID")).To(Succeed())
+		d.Stop()
+
+		d, err = adapter.NewDeduplicator(1*time.Hour, path, lager.NewLogger("test"))
+		Expect(err).ToNot(HaveOccurred())
+		defer d.Stop()
+
+		Expect(d.IsProcessed("AN_ID")).To(BeTrue())
+	})
+
+	It("can be used concurrently", func() {
+		d, err := adapter.NewDeduplicator(10*time.Millisecond, filepath.Join(tmpPath, "processed_events.jsonl"), lager.NewLogger("test"))
+		Expect(err).ToNot(HaveOccurred())
+		defer d.Stop()
+
+		var wg sync.WaitGroup
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer GinkgoRecover()
+				defer wg.Done()
+				for j := 0; j < 20; j++ {
+					id := fmt.Sprintf("%d-%d", i, j)
+					Expect(d.MarkProcessed(id)).To(Succeed())
+					_, err := d.IsProcessed(id)
+					Expect(err).ToNot(HaveOccurred())
+					time.Sleep(time.Millisecond)
+				}
+			}(i)
+		}
+		wg.Wait()
+	})
+})
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"cftools-relay/internal/domain"
 	"code.cloudfoundry.org/lager"
+	"context"
 	"encoding/json"
 	"errors"
 	"github.com/bwmarrin/discordgo"
@@ -11,18 +12,30 @@ import (
 	"net/http"
 	"strconv"
 	"text/template"
+	"time"
+)
+
+var (
+	discordClient     = &http.Client{Timeout: 30 * time.Second}
+	discordRateLimits = newRateLimiter()
 )
 
 type discordTarget struct {
+	name       string
 	webhookUrl string
+	outbox     Outbox
 	logger     lager.Logger
 }
 
-func NewDiscordTarget(webhookUrl string, logger lager.Logger) *discordTarget {
-	return &discordTarget{
+func NewDiscordTarget(name, webhookUrl string, o Outbox, logger lager.Logger) *discordTarget {
+	t := &discordTarget{
+		name:       name,
 		webhookUrl: webhookUrl,
+		outbox:     o,
 		logger:     logger,
 	}
+	o.Register(name, t.deliver)
+	return t
 }
 
 func formatType(f *domain.Filter) domain.FormatType {
@@ -58,7 +71,7 @@ func richFormatParams(e domain.Event, f *domain.Filter, p *discordgo.WebhookPara
 		})
 	}
 	if len(p.Embeds) == 0 {
-		p.Embeds = []*discordgo.MessageEmbed{}
+		p.Embeds = []*discordgo.MessageEmbed{{}}
 	}
 	p.Embeds[0].Color = color
 	p.Embeds[0].Footer = &discordgo.MessageEmbedFooter{
@@ -99,8 +112,6 @@ func textFormatParams(e domain.Event, f *domain.Filter, p *discordgo.WebhookPara
 }
 
 func (t *discordTarget) Relay(e domain.Event, f *domain.Filter, serverName *string) error {
-	l := t.logger.Session("relay", lager.Data{"event": e})
-
 	params := discordgo.WebhookParams{
 		Username: f.SendingUsername(),
 	}
@@ -129,26 +140,51 @@ func (t *discordTarget) Relay(e domain.Event, f *domain.Filter, serverName *stri
 	if err != nil {
 		return err
 	}
-	req, err := http.NewRequest("POST", t.webhookUrl, bytes.NewReader(body))
-	if err != nil {
-		return err
-	}
-	req.Header.Add("Content-Type", "application/json")
-	res, err := http.DefaultClient.Do(req)
-	defer func() {
-		err := res.Body.Close()
+	return t.outbox.Enqueue(t.name, body)
+}
+
+// deliver sends the message to Discord. When Discord rate limits the request, it is sent again after the time Discord
+// asks for, until it is accepted or ctx is done, so that rate limits delay messages, but do not use up their attempts.
+func (t *discordTarget) deliver(ctx context.Context, body []byte) error {
+	l := t.logger.Session("deliver")
+
+	for rateLimited := 0; ; rateLimited++ {
+		if err := discordRateLimits.wait(ctx, t.webhookUrl); err != nil {
+			return err
+		}
+		req, err := http.NewRequestWithContext(ctx, "POST", t.webhookUrl, bytes.NewReader(body))
 		if err != nil {
-			return
+			return Permanent(err)
 		}
-	}()
-	if res.StatusCode >= 200 && res.StatusCode <= 299 {
-		return nil
-	}
-	httpErr := errors.New("expected status code 2xx, got " + strconv.Itoa(res.StatusCode))
-	resBody, err := ioutil.ReadAll(res.Body)
-	if err != nil {
-		return err
+		req.Header.Add("Content-Type", "application/json")
+		started := time.Now()
+		res, err := discordClient.Do(req)
+		if err != nil {
+			return err
+		}
+		resBody, err := ioutil.ReadAll(res.Body)
+		if closeErr := res.Body.Close(); closeErr != nil {
+			l.Error("close-body", closeErr)
+		}
+		if err != nil {
+			return err
+		}
+		deliveryDuration.Observe(time.Since(started).Seconds(), t.name)
+		discordRateLimits.update(t.webhookUrl, res)
+
+		if res.StatusCode >= 200 && res.StatusCode <= 299 {
+			return nil
+		}
+		if res.StatusCode == http.StatusTooManyRequests {
+			retryAfter := discordRateLimits.limited(t.webhookUrl, res, resBody)
+			l.Info("rate-limited", lager.Data{"retry_after": retryAfter.String(), "times": rateLimited + 1, "global": res.Header.Get(headerRateLimitGlobal) == "true"})
+			continue
+		}
+		httpErr := errors.New("expected status code 2xx, got " + strconv.Itoa(res.StatusCode))
+		l.Error("discord", httpErr, lager.Data{"body": string(resBody)})
+		if res.StatusCode >= 400 && res.StatusCode <= 499 {
+			return Permanent(httpErr)
+		}
+		return httpErr
 	}
-	l.Error("discord", httpErr, lager.Data{"body": resBody})
-	return err
 }
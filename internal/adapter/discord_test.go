@@ -0,0 +1,189 @@
+package adapter_test
+
+import (
+	"cftools-relay/internal/adapter"
+	"cftools-relay/internal/domain"
+	"code.cloudfoundry.org/lager"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+var _ = Describe("Discord", func() {
+	var (
+		tmpPath  string
+		server   *httptest.Server
+		lock     sync.Mutex
+		requests []time.Time
+		bodies   []string
+		respond  func(w http.ResponseWriter, count int)
+		relay    func()
+		stop     func()
+	)
+
+	received := func() int {
+		lock.Lock()
+		defer lock.Unlock()
+		return len(requests)
+	}
+
+	BeforeEach(func() {
+		path, err := os.MkdirTemp("", "test-discord")
+		if err != nil {
+			panic(err)
+		}
+		tmpPath = path
+		requests = nil
+		bodies = nil
+		respond = func(w http.ResponseWriter, count int) {
+			w.WriteHeader(http.StatusNoContent)
+		}
+		server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			b, _ := ioutil.ReadAll(r.Body)
+			lock.Lock()
+			requests = append(requests, time.Now())
+			bodies = append(bodies, string(b))
+			count := len(requests)
+			lock.Unlock()
+			respond(w, count)
+		}))
+
+		o, err := adapter.NewOutbox(tmpPath, adapter.RetryPolicy{
+			MaxAttempts:    1,
+			InitialBackoff: time.Millisecond,
+			MaxBackoff:     time.Millisecond,
+		}, lager.NewLogger("test"))
+		Expect(err).ToNot(HaveOccurred())
+		t := adapter.NewDiscordTarget("default", server.URL, o, lager.NewLogger("test"))
+		Expect(o.Start()).To(Succeed())
+		relay = func() {
+			Expect(t.Relay(makeEventWithType(domain.EventUserJoin), nil, nil)).To(Succeed())
+		}
+		stop = o.Stop
+	})
+
+	AfterEach(func() {
+		stop()
+		server.Close()
+		err := os.RemoveAll(tmpPath)
+		if err != nil {
+			panic(err)
+		}
+	})
+
+	It("relays the event as an embed", func() {
+		relay()
+
+		Eventually(received).Should(Equal(1))
+		Expect(bodies[0]).To(ContainSubstring(`"embeds"`))
+		Expect(bodies[0]).To(ContainSubstring(`"username":"CFTools-Relay"`))
+	})
+
+	It("retries after the duration Discord asks for when rate limited", func() {
+		respond = func(w http.ResponseWriter, count int) {
+			if count == 1 {
+				w.Header().Set("Content-Type", "application/json")
+				w.Header().Set("Retry-After", "1")
+				w.WriteHeader(http.StatusTooManyRequests)
+				_, _ = w.Write([]byte(`{"message": "You are being rate limited.", "retry_after": 0.2, "global": false}`))
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		}
+
+		relay()
+
+		Eventually(received).Should(Equal(2))
+		Expect(requests[1].Sub(requests[0])).To(BeNumerically(">=", 200*time.Millisecond))
+		Expect(bodies[1]).To(Equal(bodies[0]))
+	})
+
+	It("keeps waiting while rate limited without using up the attempts", func() {
+		respond = func(w http.ResponseWriter, count int) {
+			if count <= 7 {
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusTooManyRequests)
+				_, _ = w.Write([]byte(`{"message": "You are being rate limited.", "retry_after": 0.01, "global": false}`))
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		}
+
+		relay()
+
+		Eventually(received).Should(Equal(8))
+		Consistently(received, 100*time.Millisecond).Should(Equal(8))
+		Expect(filepath.Join(tmpPath, "dead_letter.jsonl")).ToNot(BeAnExistingFile())
+	})
+
+	It("falls back to the Retry-After header", func() {
+		respond = func(w http.ResponseWriter, count int) {
+			if count == 1 {
+				w.Header().Set("Retry-After", "1")
+				w.WriteHeader(http.StatusTooManyRequests)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		}
+
+		relay()
+
+		Eventually(received, 3*time.Second).Should(Equal(2))
+		Expect(requests[1].Sub(requests[0])).To(BeNumerically(">=", 1*time.Second))
+	})
+
+	It("paces requests when the bucket is exhausted", func() {
+		respond = func(w http.ResponseWriter, count int) {
+			w.Header().Set("X-RateLimit-Bucket", "abcd")
+			w.Header().Set("X-RateLimit-Limit", "5")
+			if count == 1 {
+				w.Header().Set("X-RateLimit-Remaining", "0")
+			} else {
+				w.Header().Set("X-RateLimit-Remaining", "4")
+			}
+			w.Header().Set("X-RateLimit-Reset-After", "0.3")
+			w.WriteHeader(http.StatusNoContent)
+		}
+
+		relay()
+		relay()
+
+		Eventually(received).Should(Equal(2))
+		Expect(requests[1].Sub(requests[0])).To(BeNumerically(">=", 300*time.Millisecond))
+	})
+
+	It("stops waiting for the rate limit when the outbox is stopped", func() {
+		respond = func(w http.ResponseWriter, count int) {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusTooManyRequests)
+			_, _ = w.Write([]byte(`{"message": "You are being rate limited.", "retry_after": 60, "global": false}`))
+		}
+
+		relay()
+		Eventually(received).Should(Equal(1))
+
+		started := time.Now()
+		stop()
+		Expect(time.Since(started)).To(BeNumerically("<", time.Second))
+		files, err := filepath.Glob(filepath.Join(tmpPath, "default", "*.json"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(files).To(HaveLen(1))
+	})
+
+	It("does not retry messages rejected by Discord", func() {
+		respond = func(w http.ResponseWriter, count int) {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+
+		relay()
+
+		Eventually(received).Should(Equal(1))
+		Consistently(received, 100*time.Millisecond).Should(Equal(1))
+	})
+})
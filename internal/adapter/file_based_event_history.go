@@ -3,25 +3,32 @@ package adapter
 import (
 	"cftools-relay/internal/domain"
 	"encoding/json"
+	"net/url"
 	"os"
+	"path/filepath"
+	"strings"
 	"sync"
 	"time"
 )
 
+const serversDir = "servers"
+
 type repository struct {
-	dataDir string
-	lock    *sync.RWMutex
+	dataDir   string
+	retention domain.RetentionPolicy
+	lock      *sync.RWMutex
 }
 
-func NewEventRepository(dataDir string) (*repository, error) {
+func NewEventRepository(dataDir string, retention domain.RetentionPolicy) (*repository, error) {
 	if _, err := os.Stat(dataDir); os.IsNotExist(err) {
 		if err := os.Mkdir(dataDir, 0644); err != nil {
 			return nil, err
 		}
 	}
 	return &repository{
-		dataDir: dataDir,
-		lock:    &sync.RWMutex{},
+		dataDir:   dataDir,
+		retention: retention,
+		lock:      &sync.RWMutex{},
 	}, nil
 }
 
@@ -29,29 +36,116 @@ func (r repository) Save(e domain.Event) error {
 	r.lock.Lock()
 	defer r.lock.Unlock()
 
-	id := e.CFToolsId()
-	if id == nil {
+	ids := e.CFToolsIds()
+	if len(ids) == 0 {
 		return domain.ErrCFToolsIdMissing
 	}
-	dataFile, err := ensureFile(r.dataDir + "/" + *id + ".json")
-	if err != nil {
+	if err := os.MkdirAll(r.serverDir(e.Server), 0755); err != nil {
 		return err
 	}
+	for _, id := range ids {
+		dataFile, err := ensureFile(filepath.Join(r.serverDir(e.Server), id+".json"))
+		if err != nil {
+			return err
+		}
+
+		record, err := readRecords(dataFile)
+		if err != nil {
+			return err
+		}
+
+		record.Events = r.retention.Prune(append(record.Events, e), time.Now())
+		if err := writeRecords(dataFile, record); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-	record, err := readRecords(dataFile)
+func writeRecords(path string, record events) error {
+	c, err := json.Marshal(record)
 	if err != nil {
 		return err
 	}
+	return os.WriteFile(path, c, 0655)
+}
 
-	record.Events = append(record.Events, e)
-	if len(record.Events) > 100 {
-		record.Events = record.Events[len(record.Events) - 100:]
+// Compact removes the events, which are not kept according to the retention policy anymore, and deletes the files of
+// players without any event. The number of removed events is returned.
+func (r repository) Compact() (int, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	dirs, err := r.historyDirs()
+	if err != nil {
+		return 0, err
 	}
-	c, err := json.Marshal(record)
+	removed := 0
+	now := time.Now()
+	for _, dir := range dirs {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			return removed, err
+		}
+		for _, entry := range entries {
+			if entry.IsDir() || filepath.Ext(entry.Name()) != ".json" {
+				continue
+			}
+			path := filepath.Join(dir, entry.Name())
+			record, err := readRecords(path)
+			if err != nil {
+				return removed, err
+			}
+			kept := r.retention.Prune(record.Events, now)
+			removed += len(record.Events) - len(kept)
+			if len(kept) == 0 {
+				err = os.Remove(path)
+			} else if len(kept) != len(record.Events) {
+				err = writeRecords(path, events{Events: kept})
+			}
+			if err != nil {
+				return removed, err
+			}
+		}
+	}
+	return removed, nil
+}
+
+// historyDirs returns the data directory and the directories of all servers.
+func (r repository) historyDirs() ([]string, error) {
+	dirs := []string{r.dataDir}
+	servers, err := os.ReadDir(filepath.Join(r.dataDir, serversDir))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for _, s := range servers {
+		if s.IsDir() {
+			dirs = append(dirs, filepath.Join(r.dataDir, serversDir, s.Name()))
+		}
+	}
+	return dirs, nil
+}
+
+// serverDir is the directory with the history of the server. The history of events, which were saved before the
+// history was stored per server, is in the data directory itself.
+func (r repository) serverDir(server string) string {
+	return filepath.Join(r.dataDir, serversDir, "_"+url.PathEscape(server))
+}
+
+// historyFiles returns the files with the history of the player of the server, or of all servers if server is nil.
+func (r repository) historyFiles(server *string, cftoolsId string) ([]string, error) {
+	if server != nil {
+		return []string{filepath.Join(r.serverDir(*server), cftoolsId+".json")}, nil
+	}
+	dirs, err := r.historyDirs()
 	if err != nil {
-		return err
+		return nil, err
+	}
+	var files []string
+	for _, dir := range dirs {
+		files = append(files, filepath.Join(dir, cftoolsId+".json"))
 	}
-	return os.WriteFile(dataFile, c, 0655)
+	return files, nil
 }
 
 func readRecords(path string) (events, error) {
@@ -88,27 +182,114 @@ func ensureFile(path string) (string, error) {
 	return path, nil
 }
 
-func (r repository) FindWithin(eventType, cftoolsId string, within time.Duration) ([]domain.Event, error) {
+func (r repository) FindWithin(server *string, eventType, cftoolsId string, within time.Duration) ([]domain.Event, error) {
 	r.lock.RLock()
 	defer r.lock.RUnlock()
 
-	dataFile := r.dataDir + "/" + cftoolsId + ".json"
-	record, err := readRecords(dataFile)
+	files, err := r.historyFiles(server, cftoolsId)
 	if err != nil {
 		return []domain.Event{}, err
 	}
 	res := []domain.Event{}
 	latest := time.Now().Add(-within)
-	for _, event := range record.Events {
-		if event.Type != eventType {
+	for _, dataFile := range files {
+		record, err := readRecords(dataFile)
+		if err != nil {
+			return []domain.Event{}, err
+		}
+		for _, event := range record.Events {
+			if event.Type != eventType {
+				continue
+			}
+			if event.Timestamp.Before(latest) {
+				continue
+			}
+			res = append(res, event)
+		}
+	}
+	return res, nil
+}
+
+// Size returns the number of players with a history and the size of all their history files in bytes. A player, who
+// has a history on more than one server, is counted once.
+func (r repository) Size() (players int, bytes int64, err error) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	dirs, err := r.historyDirs()
+	if err != nil {
+		return 0, 0, err
+	}
+	ids := map[string]bool{}
+	for _, dir := range dirs {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			return 0, 0, err
+		}
+		for _, entry := range entries {
+			if entry.IsDir() || filepath.Ext(entry.Name()) != ".json" {
+				continue
+			}
+			info, err := entry.Info()
+			if err != nil {
+				return 0, 0, err
+			}
+			ids[entry.Name()] = true
+			bytes += info.Size()
+		}
+	}
+	return len(ids), bytes, nil
+}
+
+// ForEach calls f with each event of the history, the server and the player it was saved for. The server is nil for
+// events, which were saved before the history was stored per server.
+func (r repository) ForEach(f func(server *string, cftoolsId string, e domain.Event) error) error {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	if err := forEachInDir(r.dataDir, nil, f); err != nil {
+		return err
+	}
+	servers, err := os.ReadDir(filepath.Join(r.dataDir, serversDir))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for _, s := range servers {
+		if !s.IsDir() || !strings.HasPrefix(s.Name(), "_") {
 			continue
 		}
-		if event.Timestamp.Before(latest) {
+		server, err := url.PathUnescape(strings.TrimPrefix(s.Name(), "_"))
+		if err != nil {
+			return err
+		}
+		if err := forEachInDir(filepath.Join(r.dataDir, serversDir, s.Name()), &server, f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func forEachInDir(dir string, server *string, f func(server *string, cftoolsId string, e domain.Event) error) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if entry.IsDir() || filepath.Ext(entry.Name()) != ".json" {
 			continue
 		}
-		res = append(res, event)
+		record, err := readRecords(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return err
+		}
+		id := strings.TrimSuffix(entry.Name(), ".json")
+		for _, e := range record.Events {
+			if err := f(server, id, e); err != nil {
+				return err
+			}
+		}
 	}
-	return res, nil
+	return nil
 }
 
 type events struct {
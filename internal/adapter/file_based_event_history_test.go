@@ -3,9 +3,11 @@ package adapter_test
 import (
 	"cftools-relay/internal/adapter"
 	"cftools-relay/internal/domain"
+	"code.cloudfoundry.org/lager"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 	"os"
+	"path/filepath"
 	"time"
 )
 
@@ -21,7 +23,7 @@ var _ = Describe("EventHistory", func() {
 			panic(err)
 		}
 		tmpPath = path
-		repo, err := adapter.NewEventRepository(path)
+		repo, err := adapter.NewEventRepository(path, domain.RetentionPolicy{Default: domain.Retention{MaxEventsPerPlayer: 100}})
 		if err != nil {
 			panic(err)
 		}
@@ -41,7 +43,7 @@ var _ = Describe("EventHistory", func() {
 		err := r.Save(e)
 		Expect(err).ToNot(HaveOccurred())
 
-		saved, err := r.FindWithin(e.Type, *e.CFToolsId(), 1*time.Hour)
+		saved, err := r.FindWithin(nil, e.Type, *e.CFToolsId(), 1*time.Hour)
 		Expect(err).ToNot(HaveOccurred())
 		Expect(saved).To(HaveLen(1))
 		Expect(saved[0].Type).To(Equal(e.Type))
@@ -49,12 +51,94 @@ var _ = Describe("EventHistory", func() {
 		Expect(saved[0].Values).To(Equal(e.Values))
 	})
 
+	It("stores events per server", func() {
+		pvp := makeEventWithType(domain.EventPlayerKill)
+		pvp.Server = "pvp"
+		pve := makeEventWithType(domain.EventPlayerKill)
+		pve.Server = "pve"
+		mustSave(r, pvp)
+		mustSave(r, pvp)
+		mustSave(r, pve)
+
+		server := "pvp"
+		events, err := r.FindWithin(&server, domain.EventPlayerKill, *pvp.CFToolsId(), 1*time.Hour)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(events).To(HaveLen(2))
+		Expect(events[0].Server).To(Equal("pvp"))
+
+		events, err = r.FindWithin(nil, domain.EventPlayerKill, *pvp.CFToolsId(), 1*time.Hour)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(events).To(HaveLen(3))
+	})
+
+	It("stores events for every involved player", func() {
+		e := domain.Event{
+			Type:      domain.EventPlayerKill,
+			Timestamp: time.Now(),
+			Values: map[string]interface{}{
+				domain.FieldMurdererCfToolsId: "A_MURDERER",
+				domain.FieldVictimCfToolsId:   "A_VICTIM",
+			},
+		}
+		mustSave(r, e)
+
+		for _, id := range []string{"A_MURDERER", "A_VICTIM"} {
+			events, err := r.FindWithin(nil, domain.EventPlayerKill, id, 1*time.Hour)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(events).To(HaveLen(1))
+			Expect(events[0].Values).To(Equal(e.Values))
+		}
+	})
+
+	It("compacts the history and deletes empty files", func() {
+		mustSave(r, makeEventWithType(domain.EventUserJoin, time.Now().Add(-2*time.Hour)))
+		active := makeEventWithType(domain.EventUserJoin)
+		active.Values[domain.FieldCfToolsId] = "ACTIVE_ID"
+		mustSave(r, active)
+		mustSave(r, active)
+
+		compacting, err := adapter.NewEventRepository(tmpPath, domain.RetentionPolicy{Default: domain.Retention{MaxEventsPerPlayer: 1, MaxAge: time.Hour}})
+		Expect(err).ToNot(HaveOccurred())
+		removed, err := compacting.Compact()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(removed).To(Equal(2))
+
+		files, err := filepath.Glob(filepath.Join(tmpPath, "servers", "*", "*.json"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(files).To(ConsistOf(HaveSuffix("ACTIVE_ID.json")))
+		events, err := r.FindWithin(nil, domain.EventUserJoin, "ACTIVE_ID", time.Hour)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(events).To(HaveLen(1))
+	})
+
+	It("keeps the state files of the relay when compacting", func() {
+		path, err := adapter.StateFile(tmpPath, "sessions.json")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(path).To(Equal(filepath.Join(tmpPath, "state", "sessions.json")))
+
+		sessions, err := adapter.NewSessionTracker(r, time.Hour, path, lager.NewLogger("test"))
+		Expect(err).ToNot(HaveOccurred())
+		e := mustSave(r, makeEventWithType(domain.EventUserJoin))
+		Expect(sessions.Track(e)).To(Succeed())
+		sessions.Stop()
+
+		compacting, err := adapter.NewEventRepository(tmpPath, domain.RetentionPolicy{Default: domain.Retention{MaxEventsPerPlayer: 1}})
+		Expect(err).ToNot(HaveOccurred())
+		_, err = compacting.Compact()
+		Expect(err).ToNot(HaveOccurred())
+		players, _, err := compacting.Size()
+		Expect(err).ToNot(HaveOccurred())
+
+		Expect(path).To(BeAnExistingFile())
+		Expect(players).To(Equal(1))
+	})
+
 	It("filters events by type", func() {
 		e := mustSave(r, makeEventWithType(domain.EventUserJoin))
 		mustSave(r, makeEventWithType(domain.EventPlayerDamage))
 		e3 := mustSave(r, makeEventWithType(domain.EventUserJoin))
 
-		events, err := r.FindWithin(domain.EventUserJoin, *e.CFToolsId(), 1*time.Hour)
+		events, err := r.FindWithin(nil, domain.EventUserJoin, *e.CFToolsId(), 1*time.Hour)
 
 		Expect(err).ToNot(HaveOccurred())
 		Expect(events).To(HaveLen(2))
@@ -70,7 +154,7 @@ var _ = Describe("EventHistory", func() {
 			e = mustSave(r, makeEventWithType(domain.EventUserJoin))
 		}
 
-		events, err := r.FindWithin(domain.EventUserJoin, *e.CFToolsId(), 1*time.Hour)
+		events, err := r.FindWithin(nil, domain.EventUserJoin, *e.CFToolsId(), 1*time.Hour)
 
 		Expect(err).ToNot(HaveOccurred())
 		Expect(events).To(HaveLen(100))
@@ -82,7 +166,7 @@ var _ = Describe("EventHistory", func() {
 		mustSave(r, makeEventWithType(domain.EventUserJoin, time.Now().Add(-61*time.Minute)))
 		e3 := mustSave(r, makeEventWithType(domain.EventUserJoin, time.Now().Add(-59*time.Minute)))
 
-		events, err := r.FindWithin(domain.EventUserJoin, *e.CFToolsId(), 1*time.Hour)
+		events, err := r.FindWithin(nil, domain.EventUserJoin, *e.CFToolsId(), 1*time.Hour)
 
 		Expect(err).ToNot(HaveOccurred())
 		Expect(events).To(HaveLen(2))
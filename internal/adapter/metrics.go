@@ -0,0 +1,9 @@
+package adapter
+
+import "cftools-relay/internal/metrics"
+
+var (
+	deliveries        = metrics.NewCounterVec("cftools_relay_deliveries_total", "Delivery attempts of messages to a target by result.", "target", "result")
+	deliveryDuration  = metrics.NewHistogramVec("cftools_relay_delivery_duration_seconds", "Duration of the requests to a target, without waiting for rate limits.", metrics.DefaultBuckets, "target")
+	deadLetteredTotal = metrics.NewCounterVec("cftools_relay_dead_letters_total", "Messages moved to the dead-letter file.", "target")
+)
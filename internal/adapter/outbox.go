@@ -0,0 +1,567 @@
+package adapter
+
+import (
+	"bufio"
+	"bytes"
+	"cftools-relay/internal/domain"
+	"code.cloudfoundry.org/lager"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+const (
+	deadLetterFile = "dead_letter.jsonl"
+	// pidFile contains the process id of the relay, while its outbox is started. Redrive refuses to run, while the file
+	// exists and the process is running, as the relay appends to the dead-letter file, which Redrive rewrites.
+	pidFile = "relay.pid"
+)
+
+var (
+	ErrUnknownOutboxTarget = errors.New("no deliverer registered for target")
+	ErrOutboxRunning       = errors.New("the relay is running, stop it before redriving the dead letters")
+)
+
+// Deliverer delivers the payload of a message. ctx is done, when the outbox is stopped; the message is delivered again
+// with the next start then.
+type Deliverer func(ctx context.Context, payload []byte) error
+
+type RetryPolicy struct {
+	MaxAttempts    int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+}
+
+type OutboxMessage struct {
+	Id          string          `json:"id"`
+	Target      string          `json:"target"`
+	Payload     json.RawMessage `json:"payload"`
+	Attempts    int             `json:"attempts"`
+	CreatedAt   time.Time       `json:"created_at"`
+	NextAttempt time.Time       `json:"next_attempt"`
+	LastError   string          `json:"last_error,omitempty"`
+}
+
+type permanentError struct {
+	err error
+}
+
+func (e permanentError) Error() string {
+	return e.err.Error()
+}
+
+func (e permanentError) Unwrap() error {
+	return e.err
+}
+
+// Permanent marks a delivery error as not retryable, the message is moved to the dead-letter file right away.
+func Permanent(err error) error {
+	return permanentError{err: err}
+}
+
+type Outbox interface {
+	Register(target string, d Deliverer)
+	Start() error
+	Stop()
+	Enqueue(target string, payload []byte) error
+	Pending() int
+	Flush(ctx context.Context) int
+	Status() map[string]domain.DeliveryStatus
+	Redrive(knownTargets []string) (int, error)
+}
+
+type outboxQueue struct {
+	lock     sync.Mutex
+	messages []OutboxMessage
+	signal   chan struct{}
+	status   domain.DeliveryStatus
+}
+
+type outbox struct {
+	dir        string
+	policy     RetryPolicy
+	logger     lager.Logger
+	lock       sync.Mutex
+	queues     map[string]*outboxQueue
+	deliverers map[string]Deliverer
+	started    bool
+	sequence   uint64
+	// stopped is done, when the outbox is stopped, and cancels the deliveries in progress.
+	stopped context.Context
+	stop    context.CancelFunc
+	workers sync.WaitGroup
+}
+
+func NewOutbox(dir string, policy RetryPolicy, logger lager.Logger) (*outbox, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	stopped, stop := context.WithCancel(context.Background())
+	return &outbox{
+		dir:        dir,
+		policy:     policy,
+		logger:     logger.Session("outbox"),
+		queues:     map[string]*outboxQueue{},
+		deliverers: map[string]Deliverer{},
+		stopped:    stopped,
+		stop:       stop,
+	}, nil
+}
+
+func (o *outbox) Register(target string, d Deliverer) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	o.deliverers[target] = d
+	if _, ok := o.queues[target]; ok {
+		return
+	}
+	q := &outboxQueue{signal: make(chan struct{}, 1)}
+	o.queues[target] = q
+	if o.started {
+		if err := o.startWorker(target, q); err != nil {
+			o.logger.Error("start-worker", err, lager.Data{"target": target})
+		}
+	}
+}
+
+func (o *outbox) Start() error {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	if err := os.WriteFile(filepath.Join(o.dir, pidFile), []byte(strconv.Itoa(os.Getpid())), 0600); err != nil {
+		return err
+	}
+	o.started = true
+	for target, q := range o.queues {
+		if err := o.startWorker(target, q); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (o *outbox) startWorker(target string, q *outboxQueue) error {
+	messages, err := readOutboxMessages(o.targetDir(target))
+	if err != nil {
+		return err
+	}
+	q.lock.Lock()
+	q.messages = messages
+	q.lock.Unlock()
+	if len(messages) != 0 {
+		o.logger.Info("restored-messages", lager.Data{"target": target, "count": len(messages)})
+	}
+
+	o.workers.Add(1)
+	go o.run(target, q)
+	return nil
+}
+
+func (o *outbox) deliverer(target string) Deliverer {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	return o.deliverers[target]
+}
+
+// Stop cancels the deliveries in progress and waits until the workers exited.
+func (o *outbox) Stop() {
+	o.stop()
+	o.workers.Wait()
+
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	if !o.started {
+		return
+	}
+	o.started = false
+	if err := os.Remove(filepath.Join(o.dir, pidFile)); err != nil && !os.IsNotExist(err) {
+		o.logger.Error("remove-pid-file", err)
+	}
+}
+
+func (o *outbox) Enqueue(target string, payload []byte) error {
+	o.lock.Lock()
+	q, ok := o.queues[target]
+	o.lock.Unlock()
+	if !ok {
+		return ErrUnknownOutboxTarget
+	}
+
+	m := OutboxMessage{
+		Id:        o.nextId(),
+		Target:    target,
+		Payload:   payload,
+		CreatedAt: time.Now(),
+	}
+	if err := o.persist(m); err != nil {
+		return err
+	}
+
+	q.lock.Lock()
+	q.messages = append(q.messages, m)
+	q.lock.Unlock()
+	select {
+	case q.signal <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+func (o *outbox) Pending() int {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	count := 0
+	for _, q := range o.queues {
+		q.lock.Lock()
+		count += len(q.messages)
+		q.lock.Unlock()
+	}
+	return count
+}
+
+// Status returns the delivery status of each registered target.
+func (o *outbox) Status() map[string]domain.DeliveryStatus {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	res := map[string]domain.DeliveryStatus{}
+	for target, q := range o.queues {
+		q.lock.Lock()
+		s := q.status
+		s.Pending = len(q.messages)
+		q.lock.Unlock()
+		res[target] = s
+	}
+	return res
+}
+
+// Flush waits until all messages, which are not waiting for a retry, are delivered or ctx is done. The number of
+// messages, which remain in the outbox, is returned; they are delivered with the next start.
+func (o *outbox) Flush(ctx context.Context) int {
+	t := time.NewTicker(50 * time.Millisecond)
+	defer t.Stop()
+	for !o.flushed() {
+		select {
+		case <-ctx.Done():
+			return o.Pending()
+		case <-t.C:
+		}
+	}
+	return o.Pending()
+}
+
+func (o *outbox) flushed() bool {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	for _, q := range o.queues {
+		q.lock.Lock()
+		waiting := len(q.messages) != 0 && q.messages[0].Attempts == 0
+		q.lock.Unlock()
+		if waiting {
+			return false
+		}
+	}
+	return true
+}
+
+// Redrive moves all messages of the dead-letter file back into the outbox. Messages of targets, which are not known
+// anymore, are kept in the dead-letter file. It refuses to run, while the outbox is started by a relay, which could
+// append to the dead-letter file in the meantime.
+func (o *outbox) Redrive(knownTargets []string) (int, error) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	if o.started {
+		return 0, ErrOutboxRunning
+	}
+	path := filepath.Join(o.dir, pidFile)
+	if c, err := os.ReadFile(path); err == nil {
+		pid, err := strconv.Atoi(strings.TrimSpace(string(c)))
+		if err == nil && processRunning(pid) {
+			return 0, fmt.Errorf("%w (process %d), remove %s, if it is not running anymore", ErrOutboxRunning, pid, path)
+		}
+		// the relay exited without removing the file, e.g. because it was killed.
+		o.logger.Info("remove-stale-pid-file", lager.Data{"pid": strings.TrimSpace(string(c))})
+		if err := os.Remove(path); err != nil {
+			return 0, err
+		}
+	} else if !os.IsNotExist(err) {
+		return 0, err
+	}
+
+	messages, err := o.readDeadLetters()
+	if err != nil {
+		return 0, err
+	}
+	known := map[string]bool{}
+	for _, t := range knownTargets {
+		known[t] = true
+	}
+
+	var remaining []OutboxMessage
+	count := 0
+	for _, m := range messages {
+		if !known[m.Target] {
+			remaining = append(remaining, m)
+			continue
+		}
+		m.Attempts = 0
+		m.NextAttempt = time.Time{}
+		m.LastError = ""
+		if err := o.persist(m); err != nil {
+			return count, err
+		}
+		count++
+	}
+	return count, o.writeDeadLetters(remaining)
+}
+
+func (o *outbox) run(target string, q *outboxQueue) {
+	defer o.workers.Done()
+	l := o.logger.Session("worker", lager.Data{"target": target})
+
+	for o.stopped.Err() == nil {
+		q.lock.Lock()
+		if len(q.messages) == 0 {
+			q.lock.Unlock()
+			select {
+			case <-q.signal:
+				continue
+			case <-o.stopped.Done():
+				return
+			}
+		}
+		m := q.messages[0]
+		q.lock.Unlock()
+
+		if wait := time.Until(m.NextAttempt); wait > 0 {
+			t := time.NewTimer(wait)
+			select {
+			case <-t.C:
+			case <-o.stopped.Done():
+				t.Stop()
+				return
+			}
+		}
+
+		err := o.deliverer(target)(o.stopped, m.Payload)
+		if err != nil && o.stopped.Err() != nil {
+			// the delivery was cancelled, the message is kept without counting the attempt.
+			return
+		}
+		q.record(err)
+		if err == nil {
+			deliveries.Inc(target, "success")
+			o.remove(m)
+			q.pop()
+			continue
+		}
+
+		deliveries.Inc(target, "failure")
+		m.Attempts++
+		m.LastError = err.Error()
+		var permanent permanentError
+		if errors.As(err, &permanent) || m.Attempts >= o.policy.MaxAttempts {
+			l.Error("dead-letter", err, lager.Data{"id": m.Id, "attempts": m.Attempts})
+			err := o.deadLetter(m)
+			if err == nil {
+				deadLetteredTotal.Inc(target)
+				o.remove(m)
+				q.pop()
+				continue
+			}
+			l.Error("write-dead-letter", err, lager.Data{"id": m.Id})
+		}
+
+		m.NextAttempt = time.Now().Add(o.backoff(m.Attempts))
+		l.Info("retry", lager.Data{"id": m.Id, "attempts": m.Attempts, "next": m.NextAttempt, "error": m.LastError})
+		if err := o.persist(m); err != nil {
+			l.Error("persist", err, lager.Data{"id": m.Id})
+		}
+		q.lock.Lock()
+		q.messages[0] = m
+		q.lock.Unlock()
+	}
+}
+
+// processRunning reports whether a process with the pid is running. The own process is not, as it can not be the relay,
+// which wrote the pid file, e.g. when both run as the first process of a container.
+func processRunning(pid int) bool {
+	if pid <= 0 || pid == os.Getpid() {
+		return false
+	}
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	if runtime.GOOS == "windows" {
+		// on Windows, FindProcess fails already, if the process does not exist.
+		return true
+	}
+	err = p.Signal(syscall.Signal(0))
+	return err == nil || errors.Is(err, syscall.EPERM)
+}
+
+func (o *outbox) backoff(attempts int) time.Duration {
+	d := o.policy.InitialBackoff
+	for i := 1; i < attempts && d < o.policy.MaxBackoff; i++ {
+		d *= 2
+	}
+	if d > o.policy.MaxBackoff {
+		d = o.policy.MaxBackoff
+	}
+	if d <= 0 {
+		return 0
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+func (q *outboxQueue) record(err error) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	now := time.Now()
+	if err == nil {
+		q.status.LastSuccess = &now
+		return
+	}
+	q.status.LastFailure = &now
+	q.status.LastError = err.Error()
+}
+
+func (q *outboxQueue) pop() {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.messages = q.messages[1:]
+}
+
+func (o *outbox) nextId() string {
+	return fmt.Sprintf("%020d-%06d", time.Now().UnixNano(), atomic.AddUint64(&o.sequence, 1)%1000000)
+}
+
+func (o *outbox) targetDir(target string) string {
+	return filepath.Join(o.dir, url.PathEscape(target))
+}
+
+func (o *outbox) persist(m OutboxMessage) error {
+	dir := o.targetDir(m.Target)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	c, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(dir, m.Id+".json")
+	if err := os.WriteFile(path+".tmp", c, 0600); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+func (o *outbox) remove(m OutboxMessage) {
+	err := os.Remove(filepath.Join(o.targetDir(m.Target), m.Id+".json"))
+	if err != nil && !os.IsNotExist(err) {
+		o.logger.Error("remove-message", err, lager.Data{"id": m.Id})
+	}
+}
+
+func (o *outbox) deadLetter(m OutboxMessage) error {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	c, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(filepath.Join(o.dir, deadLetterFile), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(append(c, '\n')); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func (o *outbox) readDeadLetters() ([]OutboxMessage, error) {
+	c, err := os.ReadFile(filepath.Join(o.dir, deadLetterFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var messages []OutboxMessage
+	s := bufio.NewScanner(bytes.NewReader(c))
+	s.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	for s.Scan() {
+		if len(bytes.TrimSpace(s.Bytes())) == 0 {
+			continue
+		}
+		var m OutboxMessage
+		if err := json.Unmarshal(s.Bytes(), &m); err != nil {
+			return nil, err
+		}
+		messages = append(messages, m)
+	}
+	return messages, s.Err()
+}
+
+func (o *outbox) writeDeadLetters(messages []OutboxMessage) error {
+	var b bytes.Buffer
+	for _, m := range messages {
+		c, err := json.Marshal(m)
+		if err != nil {
+			return err
+		}
+		b.Write(c)
+		b.WriteByte('\n')
+	}
+	return os.WriteFile(filepath.Join(o.dir, deadLetterFile), b.Bytes(), 0600)
+}
+
+func readOutboxMessages(dir string) ([]OutboxMessage, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []OutboxMessage{}, nil
+		}
+		return nil, err
+	}
+	messages := []OutboxMessage{}
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+		c, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		var m OutboxMessage
+		if err := json.Unmarshal(c, &m); err != nil {
+			return nil, err
+		}
+		messages = append(messages, m)
+	}
+	sort.Slice(messages, func(i, j int) bool {
+		return messages[i].Id < messages[j].Id
+	})
+	return messages, nil
+}
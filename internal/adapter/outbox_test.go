@@ -0,0 +1,246 @@
+package adapter_test
+
+import (
+	"cftools-relay/internal/adapter"
+	"code.cloudfoundry.org/lager"
+	"context"
+	"errors"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var _ = Describe("Outbox", func() {
+	var (
+		tmpPath string
+		policy  adapter.RetryPolicy
+		logger  lager.Logger
+	)
+
+	BeforeEach(func() {
+		path, err := os.MkdirTemp("", "test-outbox")
+		if err != nil {
+			panic(err)
+		}
+		tmpPath = path
+		policy = adapter.RetryPolicy{
+			MaxAttempts:    3,
+			InitialBackoff: 1 * time.Millisecond,
+			MaxBackoff:     5 * time.Millisecond,
+		}
+		logger = lager.NewLogger("test")
+	})
+
+	AfterEach(func() {
+		err := os.RemoveAll(tmpPath)
+		if err != nil {
+			panic(err)
+		}
+	})
+
+	It("delivers enqueued messages in order", func() {
+		d := &recordingDeliverer{}
+		o, err := adapter.NewOutbox(tmpPath, policy, logger)
+		Expect(err).ToNot(HaveOccurred())
+		o.Register("default", d.deliver)
+		Expect(o.Start()).To(Succeed())
+		defer o.Stop()
+
+		Expect(o.Enqueue("default", []byte(`{"a":1}`))).To(Succeed())
+		Expect(o.Enqueue("default", []byte(`{"a":2}`))).To(Succeed())
+
+		Eventually(d.payloads).Should(Equal([]string{`{"a":1}`, `{"a":2}`}))
+		Eventually(o.Pending).Should(Equal(0))
+	})
+
+	It("flushes messages, which are not waiting for a retry", func() {
+		d := &recordingDeliverer{}
+		failing := &recordingDeliverer{failures: 100}
+		policy.InitialBackoff = time.Hour
+		policy.MaxBackoff = time.Hour
+		o, err := adapter.NewOutbox(tmpPath, policy, logger)
+		Expect(err).ToNot(HaveOccurred())
+		o.Register("default", d.deliver)
+		o.Register("failing", failing.deliver)
+		Expect(o.Start()).To(Succeed())
+		defer o.Stop()
+
+		Expect(o.Enqueue("default", []byte(`{"a":1}`))).To(Succeed())
+		Expect(o.Enqueue("failing", []byte(`{"a":2}`))).To(Succeed())
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		Expect(o.Flush(ctx)).To(Equal(1))
+		Expect(d.payloads()).To(Equal([]string{`{"a":1}`}))
+		Expect(ctx.Err()).ToNot(HaveOccurred())
+
+		status := o.Status()
+		Expect(status["default"].Healthy()).To(BeTrue())
+		Expect(status["failing"].Healthy()).To(BeFalse())
+		Expect(status["failing"].Pending).To(Equal(1))
+		Expect(status["failing"].LastError).To(Equal("delivery failed"))
+	})
+
+	It("rejects messages for unknown targets", func() {
+		o, err := adapter.NewOutbox(tmpPath, policy, logger)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(o.Enqueue("unknown", []byte(`{}`))).To(MatchError(adapter.ErrUnknownOutboxTarget))
+	})
+
+	It("retries failed deliveries", func() {
+		d := &recordingDeliverer{failures: 2}
+		o, err := adapter.NewOutbox(tmpPath, policy, logger)
+		Expect(err).ToNot(HaveOccurred())
+		o.Register("default", d.deliver)
+		Expect(o.Start()).To(Succeed())
+		defer o.Stop()
+
+		Expect(o.Enqueue("default", []byte(`{}`))).To(Succeed())
+
+		Eventually(d.payloads).Should(HaveLen(1))
+		Expect(d.attempts()).To(Equal(3))
+	})
+
+	It("moves messages to the dead-letter file after max attempts and redrives them", func() {
+		d := &recordingDeliverer{failures: 3}
+		o, err := adapter.NewOutbox(tmpPath, policy, logger)
+		Expect(err).ToNot(HaveOccurred())
+		o.Register("default", d.deliver)
+		Expect(o.Start()).To(Succeed())
+
+		Expect(o.Enqueue("default", []byte(`{}`))).To(Succeed())
+
+		Eventually(o.Pending).Should(Equal(0))
+		Expect(d.payloads()).To(HaveLen(0))
+		Expect(filepath.Join(tmpPath, "dead_letter.jsonl")).To(BeAnExistingFile())
+		o.Stop()
+
+		count, err := o.Redrive([]string{"default"})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(count).To(Equal(1))
+
+		o, err = adapter.NewOutbox(tmpPath, policy, logger)
+		Expect(err).ToNot(HaveOccurred())
+		o.Register("default", d.deliver)
+		Expect(o.Start()).To(Succeed())
+		defer o.Stop()
+		Eventually(d.payloads).Should(HaveLen(1))
+	})
+
+	It("does not redrive messages while the relay is running", func() {
+		o, err := adapter.NewOutbox(tmpPath, policy, logger)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(o.Start()).To(Succeed())
+		_, err = o.Redrive([]string{"default"})
+		Expect(err).To(MatchError(adapter.ErrOutboxRunning))
+		o.Stop()
+
+		// the parent process of the test stands in for a relay, which is running in another process.
+		Expect(os.WriteFile(filepath.Join(tmpPath, "relay.pid"), []byte(strconv.Itoa(os.Getppid())), 0600)).To(Succeed())
+		_, err = o.Redrive([]string{"default"})
+		Expect(err).To(MatchError(adapter.ErrOutboxRunning))
+	})
+
+	It("redrives messages, when the relay exited without removing its pid file", func() {
+		Expect(os.WriteFile(filepath.Join(tmpPath, "relay.pid"), []byte("999999999"), 0600)).To(Succeed())
+		o, err := adapter.NewOutbox(tmpPath, policy, logger)
+		Expect(err).ToNot(HaveOccurred())
+
+		_, err = o.Redrive([]string{"default"})
+
+		Expect(err).ToNot(HaveOccurred())
+		Expect(filepath.Join(tmpPath, "relay.pid")).ToNot(BeAnExistingFile())
+	})
+
+	It("does not deliver a message again, which was delivered while stopping", func() {
+		o, err := adapter.NewOutbox(tmpPath, policy, logger)
+		Expect(err).ToNot(HaveOccurred())
+		o.Register("default", func(ctx context.Context, _ []byte) error {
+			go o.Stop()
+			<-ctx.Done()
+			return nil
+		})
+		Expect(o.Start()).To(Succeed())
+		Expect(o.Enqueue("default", []byte(`{}`))).To(Succeed())
+		Eventually(o.Pending).Should(Equal(0))
+		o.Stop()
+
+		d := &recordingDeliverer{}
+		o, err = adapter.NewOutbox(tmpPath, policy, logger)
+		Expect(err).ToNot(HaveOccurred())
+		o.Register("default", d.deliver)
+		Expect(o.Start()).To(Succeed())
+		defer o.Stop()
+
+		Consistently(d.payloads, 100*time.Millisecond).Should(BeEmpty())
+	})
+
+	It("moves permanently failing messages to the dead-letter file right away", func() {
+		d := &recordingDeliverer{failures: 1, err: adapter.Permanent(errors.New("bad request"))}
+		o, err := adapter.NewOutbox(tmpPath, policy, logger)
+		Expect(err).ToNot(HaveOccurred())
+		o.Register("default", d.deliver)
+		Expect(o.Start()).To(Succeed())
+		defer o.Stop()
+
+		Expect(o.Enqueue("default", []byte(`{}`))).To(Succeed())
+
+		Eventually(o.Pending).Should(Equal(0))
+		Expect(d.attempts()).To(Equal(1))
+	})
+
+	It("keeps undelivered messages across restarts", func() {
+		o, err := adapter.NewOutbox(tmpPath, policy, logger)
+		Expect(err).ToNot(HaveOccurred())
+		o.Register("default", (&recordingDeliverer{failures: 100}).deliver)
+		Expect(o.Enqueue("default", []byte(`{"a":1}`))).To(Succeed())
+
+		d := &recordingDeliverer{}
+		o, err = adapter.NewOutbox(tmpPath, policy, logger)
+		Expect(err).ToNot(HaveOccurred())
+		o.Register("default", d.deliver)
+		Expect(o.Start()).To(Succeed())
+		defer o.Stop()
+
+		Eventually(d.payloads).Should(Equal([]string{`{"a":1}`}))
+	})
+})
+
+type recordingDeliverer struct {
+	lock      sync.Mutex
+	failures  int
+	err       error
+	calls     int
+	delivered []string
+}
+
+func (d *recordingDeliverer) deliver(_ context.Context, payload []byte) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	d.calls++
+	if d.calls <= d.failures {
+		if d.err != nil {
+			return d.err
+		}
+		return errors.New("delivery failed")
+	}
+	d.delivered = append(d.delivered, string(payload))
+	return nil
+}
+
+func (d *recordingDeliverer) payloads() []string {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return append([]string{}, d.delivered...)
+}
+
+func (d *recordingDeliverer) attempts() int {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return d.calls
+}
@@ -0,0 +1,132 @@
+package adapter
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	headerRetryAfter          = "Retry-After"
+	headerRateLimitGlobal     = "X-RateLimit-Global"
+	headerRateLimitRemaining  = "X-RateLimit-Remaining"
+	headerRateLimitResetAfter = "X-RateLimit-Reset-After"
+)
+
+type rateLimitBucket struct {
+	remaining int
+	resetAt   time.Time
+}
+
+// rateLimiter paces requests per webhook URL based on the rate limit headers Discord sends with every response.
+type rateLimiter struct {
+	lock          sync.Mutex
+	buckets       map[string]*rateLimitBucket
+	globalResetAt time.Time
+}
+
+func newRateLimiter() *rateLimiter {
+	return &rateLimiter{
+		buckets: map[string]*rateLimitBucket{},
+	}
+}
+
+func (r *rateLimiter) delay(key string) time.Duration {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	now := time.Now()
+	var d time.Duration
+	if r.globalResetAt.After(now) {
+		d = r.globalResetAt.Sub(now)
+	}
+	if b, ok := r.buckets[key]; ok && b.remaining <= 0 && b.resetAt.After(now) {
+		if bd := b.resetAt.Sub(now); bd > d {
+			d = bd
+		}
+	}
+	return d
+}
+
+// wait waits until a request may be sent or ctx is done, in which case the error of ctx is returned.
+func (r *rateLimiter) wait(ctx context.Context, key string) error {
+	for d := r.delay(key); d > 0; d = r.delay(key) {
+		t := time.NewTimer(d)
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+func (r *rateLimiter) update(key string, res *http.Response) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	b, ok := r.buckets[key]
+	if !ok {
+		b = &rateLimitBucket{remaining: 1}
+		r.buckets[key] = b
+	}
+	if remaining, err := strconv.Atoi(res.Header.Get(headerRateLimitRemaining)); err == nil {
+		b.remaining = remaining
+	}
+	if resetAfter, ok := parseSeconds(res.Header.Get(headerRateLimitResetAfter)); ok {
+		b.resetAt = time.Now().Add(resetAfter)
+	}
+}
+
+func (r *rateLimiter) limited(key string, res *http.Response, body []byte) time.Duration {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	retryAfter := retryAfter(res, body)
+	until := time.Now().Add(retryAfter)
+	if res.Header.Get(headerRateLimitGlobal) == "true" {
+		r.globalResetAt = until
+		return retryAfter
+	}
+	b, ok := r.buckets[key]
+	if !ok {
+		b = &rateLimitBucket{}
+		r.buckets[key] = b
+	}
+	b.remaining = 0
+	if until.After(b.resetAt) {
+		b.resetAt = until
+	}
+	return retryAfter
+}
+
+func retryAfter(res *http.Response, body []byte) time.Duration {
+	var payload struct {
+		RetryAfter float64 `json:"retry_after"`
+	}
+	if err := json.Unmarshal(body, &payload); err == nil && payload.RetryAfter > 0 {
+		return time.Duration(payload.RetryAfter * float64(time.Second))
+	}
+	if d, ok := parseSeconds(res.Header.Get(headerRetryAfter)); ok {
+		return d
+	}
+	if d, ok := parseSeconds(res.Header.Get(headerRateLimitResetAfter)); ok {
+		return d
+	}
+	return 1 * time.Second
+}
+
+func parseSeconds(v string) (time.Duration, bool) {
+	if v == "" {
+		return 0, false
+	}
+	s, err := strconv.ParseFloat(v, 64)
+	if err != nil || s < 0 {
+		return 0, false
+	}
+	return time.Duration(s * float64(time.Second)), true
+}
@@ -0,0 +1,235 @@
+package adapter
+
+import (
+	"cftools-relay/internal/domain"
+	"code.cloudfoundry.org/lager"
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+)
+
+// playerSession is the session of a player on a server. Start is nil, if the player is not online.
+type playerSession struct {
+	Start    *time.Time `json:"start,omitempty"`
+	LastSeen time.Time  `json:"last_seen"`
+	// Starts are the starts of the sessions within the last day.
+	Starts []time.Time `json:"starts,omitempty"`
+}
+
+type sessionTracker struct {
+	history    domain.EventHistory
+	staleAfter time.Duration
+	path       string
+	logger     lager.Logger
+	lock       sync.Mutex
+	servers    map[string]map[string]*playerSession
+	changed    bool
+	stop       chan struct{}
+}
+
+// NewSessionTracker creates a tracker, which ends sessions without any event of the player for staleAfter, e.g. because
+// the server restarted and no user.leave event was sent. If path is not empty, the sessions are written to this file
+// regularly, so that they are still known after a restart. The history is used to find out, whether a player joined
+// before.
+func NewSessionTracker(h domain.EventHistory, staleAfter time.Duration, path string, logger lager.Logger) (*sessionTracker, error) {
+	t := &sessionTracker{
+		history:    h,
+		staleAfter: staleAfter,
+		path:       path,
+		logger:     logger.Session("session-tracker"),
+		servers:    map[string]map[string]*playerSession{},
+		stop:       make(chan struct{}),
+	}
+	if path != "" {
+		if err := t.load(); err != nil {
+			return nil, err
+		}
+	}
+	go t.expireEvery(time.Minute)
+	return t, nil
+}
+
+func (t *sessionTracker) Track(e domain.Event) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	now := e.Timestamp
+	players, ok := t.servers[e.Server]
+	if !ok {
+		players = map[string]*playerSession{}
+		t.servers[e.Server] = players
+	}
+	if id := e.CFToolsId(); id != nil {
+		p, ok := players[*id]
+		if !ok {
+			p = &playerSession{}
+			players[*id] = p
+		}
+		if p.Start != nil && t.stale(p, now) {
+			p.Start = nil
+		}
+		switch e.Type {
+		case domain.EventUserJoin:
+			first, err := t.isFirstJoin(e.Server, *id)
+			if err != nil {
+				return err
+			}
+			e.Values[domain.VirtualFieldIsFirstJoin] = first
+			// a join of a player, who is online already, ends the previous session, as its leave event is missing.
+			p.Start = &now
+			p.Starts = append(recentStarts(p.Starts, now), now)
+			e.Values[domain.VirtualFieldSessionDuration] = 0
+		case domain.EventUserLeave:
+			if p.Start != nil {
+				e.Values[domain.VirtualFieldSessionDuration] = int(now.Sub(*p.Start).Seconds())
+				p.Start = nil
+			}
+		default:
+			if p.Start != nil {
+				e.Values[domain.VirtualFieldSessionDuration] = int(now.Sub(*p.Start).Seconds())
+			}
+		}
+		p.LastSeen = now
+		e.Values[domain.VirtualFieldSessionsToday] = sessionsSince(p.Starts, midnight(now))
+		t.changed = true
+	}
+	e.Values[domain.VirtualFieldOnlineCount] = t.online(players, now)
+	return nil
+}
+
+// isFirstJoin reports whether the history contains no other user.join event of the player on the server. The event,
+// which is tracked, is in the history already.
+func (t *sessionTracker) isFirstJoin(server, cftoolsId string) (bool, error) {
+	if t.history == nil {
+		return false, nil
+	}
+	joins, err := t.history.FindWithin(&server, domain.EventUserJoin, cftoolsId, time.Since(time.Unix(0, 0)))
+	if err != nil {
+		return false, err
+	}
+	return len(joins) <= 1, nil
+}
+
+func (t *sessionTracker) stale(p *playerSession, now time.Time) bool {
+	return now.Sub(p.LastSeen) > t.staleAfter
+}
+
+func (t *sessionTracker) online(players map[string]*playerSession, now time.Time) int {
+	count := 0
+	for _, p := range players {
+		if p.Start != nil && !t.stale(p, now) {
+			count++
+		}
+	}
+	return count
+}
+
+func midnight(t time.Time) time.Time {
+	y, m, d := t.Date()
+	return time.Date(y, m, d, 0, 0, 0, 0, t.Location())
+}
+
+func sessionsSince(starts []time.Time, since time.Time) int {
+	count := 0
+	for _, s := range starts {
+		if !s.Before(since) {
+			count++
+		}
+	}
+	return count
+}
+
+// recentStarts returns the starts of the sessions within the last day, which are needed to count the sessions of today.
+func recentStarts(starts []time.Time, now time.Time) []time.Time {
+	var res []time.Time
+	for _, s := range starts {
+		if now.Sub(s) < 24*time.Hour {
+			res = append(res, s)
+		}
+	}
+	return res
+}
+
+func (t *sessionTracker) Stop() {
+	close(t.stop)
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if err := t.save(); err != nil {
+		t.logger.Error("save", err)
+	}
+}
+
+func (t *sessionTracker) expireEvery(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := t.expire(time.Now()); err != nil {
+				t.logger.Error("expire", err)
+			}
+		case <-t.stop:
+			return
+		}
+	}
+}
+
+// expire ends stale sessions and forgets players, who are not online and did not join within the last day.
+func (t *sessionTracker) expire(now time.Time) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	ended := 0
+	for server, players := range t.servers {
+		for id, p := range players {
+			if p.Start != nil && t.stale(p, now) {
+				p.Start = nil
+				ended++
+			}
+			p.Starts = recentStarts(p.Starts, now)
+			if p.Start == nil && len(p.Starts) == 0 {
+				delete(players, id)
+				t.changed = true
+			}
+		}
+		if len(players) == 0 {
+			delete(t.servers, server)
+		}
+	}
+	if ended != 0 {
+		t.logger.Info("end-stale-sessions", lager.Data{"ended": ended})
+		t.changed = true
+	}
+	return t.save()
+}
+
+func (t *sessionTracker) save() error {
+	if t.path == "" || !t.changed {
+		return nil
+	}
+	c, err := json.Marshal(t.servers)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(t.path+".tmp", c, 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(t.path+".tmp", t.path); err != nil {
+		return err
+	}
+	t.changed = false
+	return nil
+}
+
+func (t *sessionTracker) load() error {
+	c, err := os.ReadFile(t.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	return json.Unmarshal(c, &t.servers)
+}
@@ -0,0 +1,115 @@
+package adapter_test
+
+import (
+	"cftools-relay/internal/adapter"
+	"cftools-relay/internal/domain"
+	"code.cloudfoundry.org/lager"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+var _ = Describe("SessionTracker", func() {
+	var (
+		tmpPath string
+		history domain.EventHistory
+		start   time.Time
+	)
+
+	BeforeEach(func() {
+		path, err := os.MkdirTemp("", "test-sessions")
+		if err != nil {
+			panic(err)
+		}
+		tmpPath = path
+		history, err = adapter.NewEventRepository(filepath.Join(path, "history"), domain.RetentionPolicy{Default: domain.Retention{MaxEventsPerPlayer: 100}})
+		Expect(err).ToNot(HaveOccurred())
+		start = time.Now().Add(-3 * time.Hour)
+	})
+
+	AfterEach(func() {
+		err := os.RemoveAll(tmpPath)
+		if err != nil {
+			panic(err)
+		}
+	})
+
+	track := func(t domain.SessionTracker, eventType, id string, at time.Time) domain.Event {
+		e := domain.Event{Type: eventType, Server: "pvp", Timestamp: at, Values: map[string]interface{}{domain.FieldCfToolsId: id}}
+		Expect(history.Save(e)).To(Succeed())
+		Expect(t.Track(e)).To(Succeed())
+		return e
+	}
+
+	It("pairs joins and leaves of a player", func() {
+		t, err := adapter.NewSessionTracker(history, time.Hour, "", lager.NewLogger("test"))
+		Expect(err).ToNot(HaveOccurred())
+		defer t.Stop()
+
+		join := track(t, domain.EventUserJoin, "AN_ID", start)
+		Expect(join.Values).To(HaveKeyWithValue(domain.VirtualFieldSessionDuration, 0))
+		Expect(join.Values).To(HaveKeyWithValue(domain.VirtualFieldOnlineCount, 1))
+
+		chat := track(t, domain.EventUserChat, "AN_ID", start.Add(10*time.Minute))
+		Expect(chat.Values).To(HaveKeyWithValue(domain.VirtualFieldSessionDuration, 600))
+
+		leave := track(t, domain.EventUserLeave, "AN_ID", start.Add(25*time.Minute))
+		Expect(leave.Values).To(HaveKeyWithValue(domain.VirtualFieldSessionDuration, 1500))
+		Expect(leave.Values).To(HaveKeyWithValue(domain.VirtualFieldOnlineCount, 0))
+	})
+
+	It("recognises the first join of a player on the server", func() {
+		t, err := adapter.NewSessionTracker(history, time.Hour, "", lager.NewLogger("test"))
+		Expect(err).ToNot(HaveOccurred())
+		defer t.Stop()
+
+		Expect(track(t, domain.EventUserJoin, "AN_ID", start).Values).To(HaveKeyWithValue(domain.VirtualFieldIsFirstJoin, true))
+		track(t, domain.EventUserLeave, "AN_ID", start.Add(time.Minute))
+		Expect(track(t, domain.EventUserJoin, "AN_ID", start.Add(2*time.Minute)).Values).To(HaveKeyWithValue(domain.VirtualFieldIsFirstJoin, false))
+	})
+
+	It("counts the sessions of today and the players online", func() {
+		t, err := adapter.NewSessionTracker(history, time.Hour, "", lager.NewLogger("test"))
+		Expect(err).ToNot(HaveOccurred())
+		defer t.Stop()
+
+		now := time.Now()
+		track(t, domain.EventUserJoin, "AN_ID", now)
+		track(t, domain.EventUserLeave, "AN_ID", now)
+		track(t, domain.EventUserJoin, "ANOTHER_ID", now)
+		join := track(t, domain.EventUserJoin, "AN_ID", now)
+
+		Expect(join.Values).To(HaveKeyWithValue(domain.VirtualFieldSessionsToday, 2))
+		Expect(join.Values).To(HaveKeyWithValue(domain.VirtualFieldOnlineCount, 2))
+	})
+
+	It("ends sessions without any event of the player for the stale timeout", func() {
+		t, err := adapter.NewSessionTracker(history, time.Hour, "", lager.NewLogger("test"))
+		Expect(err).ToNot(HaveOccurred())
+		defer t.Stop()
+
+		track(t, domain.EventUserJoin, "AN_ID", start)
+		track(t, domain.EventUserJoin, "ANOTHER_ID", start.Add(90*time.Minute))
+		leave := track(t, domain.EventUserLeave, "AN_ID", start.Add(2*time.Hour))
+
+		Expect(leave.Values).ToNot(HaveKey(domain.VirtualFieldSessionDuration))
+		Expect(leave.Values).To(HaveKeyWithValue(domain.VirtualFieldOnlineCount, 1))
+	})
+
+	It("keeps the sessions after a restart", func() {
+		path := filepath.Join(tmpPath, "sessions.json")
+		t, err := adapter.NewSessionTracker(history, time.Hour, path, lager.NewLogger("test"))
+		Expect(err).ToNot(HaveOccurred())
+		track(t, domain.EventUserJoin, "AN_ID", start)
+		t.Stop()
+
+		t, err = adapter.NewSessionTracker(history, time.Hour, path, lager.NewLogger("test"))
+		Expect(err).ToNot(HaveOccurred())
+		defer t.Stop()
+		leave := track(t, domain.EventUserLeave, "AN_ID", start.Add(30*time.Minute))
+
+		Expect(leave.Values).To(HaveKeyWithValue(domain.VirtualFieldSessionDuration, 1800))
+	})
+})
@@ -0,0 +1,229 @@
+package adapter
+
+import (
+	"cftools-relay/internal/domain"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"math"
+	"os"
+	"strings"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+var ErrHistoryNotEmpty = errors.New("the history database contains events already")
+
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS events (
+	id         INTEGER PRIMARY KEY AUTOINCREMENT,
+	server     TEXT,
+	cftools_id TEXT    NOT NULL,
+	type       TEXT    NOT NULL,
+	timestamp  INTEGER NOT NULL,
+	event      TEXT    NOT NULL
+);
+CREATE INDEX IF NOT EXISTS events_by_player ON events (cftools_id, type, timestamp);
+CREATE INDEX IF NOT EXISTS events_by_server_player ON events (server, cftools_id, id);
+`
+
+// EventSource provides all events of a history, e.g. for importing them into another one.
+type EventSource interface {
+	ForEach(f func(server *string, cftoolsId string, e domain.Event) error) error
+}
+
+type sqliteRepository struct {
+	path      string
+	retention domain.RetentionPolicy
+	db        *sql.DB
+}
+
+// NewSqliteEventRepository opens the SQLite database at path, which is created if it does not exist yet.
+func NewSqliteEventRepository(path string, retention domain.RetentionPolicy) (*sqliteRepository, error) {
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, err
+	}
+	// SQLite allows one writer at a time only, a single connection avoids busy errors of concurrent writes.
+	db.SetMaxOpenConns(1)
+	if _, err := db.Exec(sqliteSchema); err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	return &sqliteRepository{path: path, retention: retention, db: db}, nil
+}
+
+func (r *sqliteRepository) Save(e domain.Event) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	ids := e.CFToolsIds()
+	if len(ids) == 0 {
+		return domain.ErrCFToolsIdMissing
+	}
+	for _, id := range ids {
+		if err := r.insert(tx, &e.Server, id, e); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// insert saves the event for the server and player. Events without a server are from before the history was stored per
+// server, they are found for all servers only.
+func (r *sqliteRepository) insert(tx *sql.Tx, server *string, id string, e domain.Event) error {
+	c, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`INSERT INTO events (server, cftools_id, type, timestamp, event) VALUES (?, ?, ?, ?, ?)`,
+		server, id, e.Type, e.Timestamp.UnixNano(), string(c))
+	if err != nil {
+		return err
+	}
+	retention := r.retention.For(e.Type)
+	_, err = tx.Exec(`DELETE FROM events WHERE server IS ? AND cftools_id = ? AND type = ? AND (timestamp < ? OR id NOT IN (
+		SELECT id FROM events WHERE server IS ? AND cftools_id = ? AND type = ? ORDER BY id DESC LIMIT ?
+	))`, server, id, e.Type, oldestTimestamp(retention, time.Now()), server, id, e.Type, limit(retention))
+	return err
+}
+
+// Compact removes the events, which are not kept according to the retention policy anymore. The number of removed
+// events is returned.
+func (r *sqliteRepository) Compact() (int, error) {
+	now := time.Now()
+	var others []interface{}
+	removed := 0
+	for eventType, retention := range r.retention.EventTypes {
+		n, err := r.compact("type = ?", []interface{}{eventType}, retention, now)
+		removed += n
+		if err != nil {
+			return removed, err
+		}
+		others = append(others, eventType)
+	}
+	condition := "1 = 1"
+	if len(others) != 0 {
+		condition = "type NOT IN (?" + strings.Repeat(", ?", len(others)-1) + ")"
+	}
+	n, err := r.compact(condition, others, r.retention.Default, now)
+	return removed + n, err
+}
+
+func (r *sqliteRepository) compact(condition string, args []interface{}, retention domain.Retention, now time.Time) (int, error) {
+	query := `DELETE FROM events WHERE ` + condition + ` AND (timestamp < ? OR id IN (
+		SELECT id FROM (
+			SELECT id, ROW_NUMBER() OVER (PARTITION BY server, cftools_id, type ORDER BY id DESC) AS n FROM events WHERE ` + condition + `
+		) WHERE ? > 0 AND n > ?
+	))`
+	params := append(append([]interface{}{}, args...), oldestTimestamp(retention, now))
+	params = append(params, args...)
+	params = append(params, retention.MaxEventsPerPlayer, retention.MaxEventsPerPlayer)
+	res, err := r.db.Exec(query, params...)
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	return int(n), err
+}
+
+// oldestTimestamp returns the timestamp of the oldest event, which is kept according to the retention.
+func oldestTimestamp(r domain.Retention, now time.Time) int64 {
+	if r.MaxAge == 0 {
+		return math.MinInt64
+	}
+	return now.Add(-r.MaxAge).UnixNano()
+}
+
+// limit returns the maximum number of events, which are kept according to the retention; -1 means no limit in SQLite.
+func limit(r domain.Retention) int {
+	if r.MaxEventsPerPlayer <= 0 {
+		return -1
+	}
+	return r.MaxEventsPerPlayer
+}
+
+func (r *sqliteRepository) FindWithin(server *string, eventType, cftoolsId string, within time.Duration) ([]domain.Event, error) {
+	query := `SELECT event FROM events WHERE cftools_id = ? AND type = ? AND timestamp >= ?`
+	args := []interface{}{cftoolsId, eventType, time.Now().Add(-within).UnixNano()}
+	if server != nil {
+		query += ` AND server = ?`
+		args = append(args, *server)
+	}
+	rows, err := r.db.Query(query+` ORDER BY id`, args...)
+	if err != nil {
+		return []domain.Event{}, err
+	}
+	defer rows.Close()
+
+	res := []domain.Event{}
+	for rows.Next() {
+		var c string
+		if err := rows.Scan(&c); err != nil {
+			return []domain.Event{}, err
+		}
+		var e domain.Event
+		if err := json.Unmarshal([]byte(c), &e); err != nil {
+			return []domain.Event{}, err
+		}
+		res = append(res, e)
+	}
+	return res, rows.Err()
+}
+
+// Size returns the number of players with a history and the size of the database file in bytes.
+func (r *sqliteRepository) Size() (players int, bytes int64, err error) {
+	if err := r.db.QueryRow(`SELECT COUNT(DISTINCT cftools_id) FROM events`).Scan(&players); err != nil {
+		return 0, 0, err
+	}
+	info, err := os.Stat(r.path)
+	if err != nil {
+		return 0, 0, err
+	}
+	return players, info.Size(), nil
+}
+
+// Import copies all events of the file based history into the database, which needs to be empty. The number of imported
+// events is returned.
+func (r *sqliteRepository) Import(from EventSource) (int, error) {
+	empty, err := r.empty()
+	if err != nil {
+		return 0, err
+	}
+	if !empty {
+		return 0, ErrHistoryNotEmpty
+	}
+	tx, err := r.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	count := 0
+	err = from.ForEach(func(server *string, cftoolsId string, e domain.Event) error {
+		if err := r.insert(tx, server, cftoolsId, e); err != nil {
+			return err
+		}
+		count++
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return count, tx.Commit()
+}
+
+func (r *sqliteRepository) empty() (bool, error) {
+	var count int
+	err := r.db.QueryRow(`SELECT COUNT(*) FROM (SELECT 1 FROM events LIMIT 1)`).Scan(&count)
+	return count == 0, err
+}
+
+func (r *sqliteRepository) Close() error {
+	return r.db.Close()
+}
@@ -0,0 +1,164 @@
+package adapter_test
+
+import (
+	"cftools-relay/internal/adapter"
+	"cftools-relay/internal/domain"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+var _ = Describe("SqliteEventHistory", func() {
+	var (
+		tmpPath string
+		r       domain.EventHistory
+	)
+
+	open := func() interface {
+		domain.EventHistory
+		Import(from adapter.EventSource) (int, error)
+		Close() error
+	} {
+		repo, err := adapter.NewSqliteEventRepository(filepath.Join(tmpPath, "history.db"), domain.RetentionPolicy{Default: domain.Retention{MaxEventsPerPlayer: 100}})
+		Expect(err).ToNot(HaveOccurred())
+		return repo
+	}
+
+	BeforeEach(func() {
+		path, err := os.MkdirTemp("", "test-sqlite")
+		if err != nil {
+			panic(err)
+		}
+		tmpPath = path
+		r = open()
+	})
+
+	AfterEach(func() {
+		err := os.RemoveAll(tmpPath)
+		if err != nil {
+			panic(err)
+		}
+	})
+
+	It("persists event", func() {
+		e := makeEventWithType(domain.EventUserJoin)
+		e.Values["distance"] = 12.5
+
+		mustSave(r, e)
+
+		saved, err := r.FindWithin(nil, e.Type, *e.CFToolsId(), 1*time.Hour)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(saved).To(HaveLen(1))
+		Expect(saved[0].Type).To(Equal(e.Type))
+		Expect(saved[0].Timestamp).To(BeTemporally("==", e.Timestamp))
+		Expect(saved[0].Values).To(Equal(e.Values))
+	})
+
+	It("returns events of the type, server and timeframe only", func() {
+		e := makeEventWithType(domain.EventPlayerKill, time.Now().Add(-30*time.Minute))
+		e.Server = "pvp"
+		mustSave(r, e)
+		mustSave(r, makeEventWithType(domain.EventPlayerKill, time.Now().Add(-61*time.Minute)))
+		mustSave(r, makeEventWithType(domain.EventUserJoin))
+		mustSave(r, makeEventWithType(domain.EventPlayerKill))
+
+		events, err := r.FindWithin(nil, domain.EventPlayerKill, *e.CFToolsId(), 1*time.Hour)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(events).To(HaveLen(2))
+		Expect(events[0].Server).To(Equal("pvp"))
+
+		server := "pvp"
+		events, err = r.FindWithin(&server, domain.EventPlayerKill, *e.CFToolsId(), 1*time.Hour)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(events).To(HaveLen(1))
+	})
+
+	It("stores events for every involved player", func() {
+		e := domain.Event{
+			Type:      domain.EventPlayerKill,
+			Timestamp: time.Now(),
+			Values: map[string]interface{}{
+				domain.FieldMurdererCfToolsId: "A_MURDERER",
+				domain.FieldVictimCfToolsId:   "A_VICTIM",
+			},
+		}
+		mustSave(r, e)
+
+		for _, id := range []string{"A_MURDERER", "A_VICTIM"} {
+			events, err := r.FindWithin(nil, domain.EventPlayerKill, id, 1*time.Hour)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(events).To(HaveLen(1))
+			Expect(events[0].Values).To(Equal(e.Values))
+		}
+	})
+
+	It("does not save more than 100 events per id", func() {
+		var e domain.Event
+		for i := 0; i < 101; i++ {
+			e = mustSave(r, makeEventWithType(domain.EventUserJoin))
+		}
+
+		events, err := r.FindWithin(nil, domain.EventUserJoin, *e.CFToolsId(), 1*time.Hour)
+
+		Expect(err).ToNot(HaveOccurred())
+		Expect(events).To(HaveLen(100))
+		Expect(events[len(events)-1].Timestamp).To(BeTemporally("==", e.Timestamp))
+	})
+
+	It("compacts the history according to the retention of each event type", func() {
+		mustSave(r, makeEventWithType(domain.EventUserJoin, time.Now().Add(-2*time.Hour)))
+		mustSave(r, makeEventWithType(domain.EventUserJoin))
+		for i := 0; i < 3; i++ {
+			mustSave(r, makeEventWithType(domain.EventPlayerKill, time.Now().Add(-2*time.Hour)))
+		}
+		Expect(r.(interface{ Close() error }).Close()).To(Succeed())
+
+		compacting, err := adapter.NewSqliteEventRepository(filepath.Join(tmpPath, "history.db"), domain.RetentionPolicy{
+			Default:    domain.Retention{MaxEventsPerPlayer: 100, MaxAge: time.Hour},
+			EventTypes: map[string]domain.Retention{domain.EventPlayerKill: {MaxEventsPerPlayer: 2, MaxAge: 24 * time.Hour}},
+		})
+		Expect(err).ToNot(HaveOccurred())
+		defer compacting.Close()
+		removed, err := compacting.Compact()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(removed).To(Equal(2))
+
+		events, err := compacting.FindWithin(nil, domain.EventUserJoin, "AN_ID", 24*time.Hour)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(events).To(HaveLen(1))
+		events, err = compacting.FindWithin(nil, domain.EventPlayerKill, "AN_ID", 24*time.Hour)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(events).To(HaveLen(2))
+	})
+
+	It("imports the file based history", func() {
+		files, err := adapter.NewEventRepository(filepath.Join(tmpPath, "storage"), domain.RetentionPolicy{Default: domain.Retention{MaxEventsPerPlayer: 100}})
+		Expect(err).ToNot(HaveOccurred())
+		e := makeEventWithType(domain.EventPlayerKill)
+		e.Server = "pvp"
+		mustSave(files, e)
+		mustSave(files, e)
+		Expect(os.WriteFile(filepath.Join(tmpPath, "storage", "LEGACY_ID.json"), []byte(`{"Events": [{"Type": "player.kill", "Timestamp": "`+time.Now().Format(time.RFC3339Nano)+`", "Values": {"cftools_id": "LEGACY_ID"}}]}`), 0644)).To(Succeed())
+
+		db := open()
+		count, err := db.Import(files)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(count).To(Equal(3))
+
+		server := "pvp"
+		events, err := db.FindWithin(&server, domain.EventPlayerKill, *e.CFToolsId(), 1*time.Hour)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(events).To(HaveLen(2))
+		events, err = db.FindWithin(nil, domain.EventPlayerKill, "LEGACY_ID", 1*time.Hour)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(events).To(HaveLen(1))
+		events, err = db.FindWithin(&server, domain.EventPlayerKill, "LEGACY_ID", 1*time.Hour)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(events).To(BeEmpty())
+
+		_, err = db.Import(files)
+		Expect(err).To(MatchError(adapter.ErrHistoryNotEmpty))
+	})
+})
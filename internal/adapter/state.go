@@ -0,0 +1,20 @@
+package adapter
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// stateDir is the directory in the storage path with the state of the relay, like the sessions and the processed
+// events. It is kept apart from the history files, which are compacted and counted as players.
+const stateDir = "state"
+
+// StateFile returns the path of the state file with the name in the storage path and creates the state directory, if
+// needed.
+func StateFile(storagePath, name string) (string, error) {
+	dir := filepath.Join(storagePath, stateDir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, name), nil
+}
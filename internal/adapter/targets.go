@@ -0,0 +1,20 @@
+package adapter
+
+import (
+	"cftools-relay/internal/domain"
+	"code.cloudfoundry.org/lager"
+	"fmt"
+)
+
+func NewTargets(c map[string]domain.TargetConfig, o Outbox, logger lager.Logger) (map[string]domain.Target, error) {
+	targets := map[string]domain.Target{}
+	for name, config := range c {
+		switch config.Type {
+		case domain.TargetTypeDiscord:
+			targets[name] = NewDiscordTarget(name, config.WebhookUrl, o, logger.Session("target", lager.Data{"name": name}))
+		default:
+			return nil, fmt.Errorf("target %s has unknown type %s", name, config.Type)
+		}
+	}
+	return targets, nil
+}
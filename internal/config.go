@@ -1,92 +1,397 @@
 package internal
 
 import (
+	"bytes"
 	"cftools-relay/internal/domain"
 	"code.cloudfoundry.org/lager"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"net/url"
 	"os"
+	"time"
 )
 
+// ConfigVersion is the current version of the config schema. Configs without a version are from before strict
+// comparators were introduced, where gt and lt matched equal values as well.
+const ConfigVersion = 2
+
 type Discord struct {
 	WebhookUrl string `json:"webhook_url"`
 }
 
+const (
+	HistoryDriverFile   = "file"
+	HistoryDriverSqlite = "sqlite"
+)
+
 type History struct {
 	StoragePath string `json:"storage_path"`
+	// Driver selects how the history is stored, either in one file per player (file) or in a SQLite database (sqlite).
+	Driver             string                      `json:"driver,omitempty"`
+	MaxEventsPerPlayer int                         `json:"max_events_per_player"`
+	MaxAge             string                      `json:"max_age,omitempty"`
+	EventTypes         map[string]HistoryRetention `json:"event_types,omitempty"`
+}
+
+// HistoryRetention overrides the retention of the history for a single event type. Settings, which are not set, are
+// the ones of the history.
+type HistoryRetention struct {
+	MaxEventsPerPlayer int    `json:"max_events_per_player,omitempty"`
+	MaxAge             string `json:"max_age,omitempty"`
+}
+
+type Delivery struct {
+	MaxAttempts    int    `json:"max_attempts"`
+	InitialBackoff string `json:"initial_backoff"`
+	MaxBackoff     string `json:"max_backoff"`
+}
+
+type Processing struct {
+	Workers   int `json:"workers"`
+	QueueSize int `json:"queue_size"`
+}
+
+type Shutdown struct {
+	Timeout string `json:"timeout"`
+}
+
+type Sessions struct {
+	StaleTimeout string `json:"stale_timeout"`
+}
+
+type Deduplication struct {
+	TTL     string `json:"ttl"`
+	Persist *bool  `json:"persist,omitempty"`
 }
 
 type Config struct {
-	Port    int                      `json:"port"`
-	Secret  string                   `json:"secret,omitempty"`
-	Servers map[string]domain.Server `json:"servers"`
-	Discord Discord                  `json:"discord"`
-	History History                  `json:"history"`
-	Filter  domain.FilterList        `json:"filter"`
+	Version       int                            `json:"version"`
+	Port          int                            `json:"port"`
+	AdminPort     int                            `json:"admin_port,omitempty"`
+	Secret        string                         `json:"secret,omitempty"`
+	Servers       map[string]domain.Server       `json:"servers"`
+	Discord       *Discord                       `json:"discord,omitempty"`
+	Targets       map[string]domain.TargetConfig `json:"targets"`
+	History       History                        `json:"history"`
+	Delivery      Delivery                       `json:"delivery"`
+	Processing    Processing                     `json:"processing"`
+	Shutdown      Shutdown                       `json:"shutdown"`
+	Deduplication Deduplication                  `json:"deduplication"`
+	Sessions      Sessions                       `json:"sessions"`
+	Zones         map[string]domain.Zone         `json:"zones,omitempty"`
+	Filter        domain.FilterList              `json:"filter"`
 }
 
 func NewConfig(path string, logger lager.Logger) (Config, error) {
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		logger.Info("create-config")
+		if err := persistConfig(path, defaultConfig()); err != nil {
+			return Config{}, err
+		}
+	}
+	config, migrated, err := loadConfig(path, logger)
+	if err == nil && migrated {
+		logger.Info("legacy-config", lager.Data{"hint": "run the migrate-config command to upgrade the config file to the current format"})
+	}
+	if err == nil {
+		LogWarnings(config, logger)
+	}
+	return config, err
+}
+
+// LogWarnings logs the warnings of the config, see Config.Warnings.
+func LogWarnings(config Config, logger lager.Logger) {
+	for _, w := range config.Warnings() {
+		logger.Info("config-warning", lager.Data{"path": w.Path, "warning": w.Message})
+	}
+}
+
+// LoadConfig reads the config at path, upgrades legacy shapes to the current schema and validates it. The config file
+// itself is never changed.
+func LoadConfig(path string, logger lager.Logger) (Config, error) {
+	config, _, err := loadConfig(path, logger)
+	return config, err
+}
+
+// MigrateConfig upgrades the config file at path to the current schema. The previous content is written to a
+// timestamped backup file first, the path of the backup is returned. Nothing is written, if the config is up-to-date
+// already. Only the legacy shapes are rewritten, settings, which are not set, keep their implicit defaults.
+func MigrateConfig(path string, logger lager.Logger) (string, error) {
+	original, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	if _, migrated, err := loadConfig(path, logger); err != nil || !migrated {
+		return "", err
+	}
 	config, err := readConfig(path, logger)
 	if err != nil {
-		return config, err
+		return "", err
 	}
+	if _, err := migrate(&config); err != nil {
+		return "", err
+	}
+	content, err := migratedContent(original, config)
+	if err != nil {
+		return "", err
+	}
+	backup := fmt.Sprintf("%s.%s.bak", path, time.Now().Format("20060102-150405"))
+	if err := os.WriteFile(backup, original, 0600); err != nil {
+		return "", err
+	}
+	return backup, writeConfig(path, content)
+}
 
-	if config.Filter == nil {
-		config.Filter = domain.FilterList{}
-	} else {
-		for i, filter := range config.Filter {
-			if (filter.Color != "" || filter.Message != "") && (filter.Format == nil || filter.Format.Type == "") {
-				config.Filter[i].Format = &domain.Format{
-					Type: domain.FormatTypeRich,
-					Parameters: map[string]interface{}{
-						"color":   filter.Color,
-						"message": filter.Message,
-					},
-				}
-				config.Filter[i].Color = ""
-				config.Filter[i].Message = ""
-			}
+// migratedContent replaces the settings of the original config, which migrate might change, with the ones of the
+// migrated config. All other settings are kept as they are.
+func migratedContent(original []byte, config Config) ([]byte, error) {
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(original, &raw); err != nil {
+		return nil, err
+	}
+	delete(raw, "secret")
+	delete(raw, "discord")
+	migrated := map[string]interface{}{"version": config.Version}
+	if config.Servers != nil {
+		migrated["servers"] = config.Servers
+	}
+	if config.Targets != nil {
+		migrated["targets"] = config.Targets
+	}
+	if config.Filter != nil {
+		migrated["filter"] = config.Filter
+	}
+	for key, value := range migrated {
+		c, err := json.Marshal(value)
+		if err != nil {
+			return nil, err
 		}
+		raw[key] = c
 	}
-	if config.History.StoragePath == "" {
-		config.History.StoragePath = "./storage"
+	return json.MarshalIndent(raw, "", "  ")
+}
+
+func loadConfig(path string, logger lager.Logger) (Config, bool, error) {
+	config, err := readConfig(path, logger)
+	if err != nil {
+		return config, false, err
+	}
+	migrated, err := migrate(&config)
+	if err != nil {
+		return config, migrated, err
+	}
+	applyDefaults(&config)
+
+	if errs := config.Validate(); len(errs) != 0 {
+		return config, migrated, errs
+	}
+	if err := config.Filter.Compile(); err != nil {
+		return config, migrated, err
+	}
+	config.Filter.UseZones(config.Zones)
+	for id, server := range config.Servers {
+		if err := server.Filter.CompileAs("servers." + id + ".filter"); err != nil {
+			return config, migrated, err
+		}
+		server.Filter.UseZones(config.Zones)
+	}
+	return config, migrated, nil
+}
+
+func defaultConfig() Config {
+	return Config{
+		Version: ConfigVersion,
+		Port:    8080,
+		Targets: map[string]domain.TargetConfig{
+			domain.DefaultTarget: {Type: domain.TargetTypeDiscord},
+		},
+	}
+}
+
+// migrate upgrades shapes of older versions of the config to the current schema and reports whether anything changed.
+func migrate(config *Config) (bool, error) {
+	migrated := migrateLegacyFormats(config.Filter)
+	for _, server := range config.Servers {
+		if migrateLegacyFormats(server.Filter) {
+			migrated = true
+		}
 	}
 	if len(config.Servers) != 0 && config.Secret != "" {
-		return config, errors.New("can not have a secret and servers configured at the same time")
+		return migrated, errors.New("can not have a secret and servers configured at the same time")
 	}
 	if config.Secret != "" {
 		config.Servers = map[string]domain.Server{}
 		config.Servers[""] = domain.Server{Secret: config.Secret}
 		config.Secret = ""
+		migrated = true
+	}
+	if config.Discord != nil {
+		if _, ok := config.Targets[domain.DefaultTarget]; ok {
+			return migrated, errors.New("can not have a discord webhook_url and a default target configured at the same time")
+		}
+		if config.Targets == nil {
+			config.Targets = map[string]domain.TargetConfig{}
+		}
+		config.Targets[domain.DefaultTarget] = domain.TargetConfig{
+			Type:       domain.TargetTypeDiscord,
+			WebhookUrl: config.Discord.WebhookUrl,
+		}
+		config.Discord = nil
+		migrated = true
 	}
-	for name, _ := range config.Servers {
-		if url.PathEscape(name) != name {
-			return config, fmt.Errorf("%s is expected to be URL-safe", name)
+	if config.Version < 2 {
+		for _, filter := range config.Filter {
+			migrateInclusiveComparators(filter.Rules)
+		}
+		for _, server := range config.Servers {
+			for _, filter := range server.Filter {
+				migrateInclusiveComparators(filter.Rules)
+			}
 		}
+		config.Version = ConfigVersion
+		migrated = true
 	}
+	return migrated, nil
+}
 
-	return config, persistConfig(path, config)
+func applyDefaults(config *Config) {
+	if config.Filter == nil {
+		config.Filter = domain.FilterList{}
+	}
+	if config.Targets == nil {
+		config.Targets = map[string]domain.TargetConfig{}
+	}
+	if config.History.StoragePath == "" {
+		config.History.StoragePath = "./storage"
+	}
+	if config.History.Driver == "" {
+		config.History.Driver = HistoryDriverFile
+	}
+	if config.History.MaxEventsPerPlayer == 0 {
+		config.History.MaxEventsPerPlayer = 100
+	}
+	if config.Delivery.MaxAttempts == 0 {
+		config.Delivery.MaxAttempts = 10
+	}
+	if config.Delivery.InitialBackoff == "" {
+		config.Delivery.InitialBackoff = "2s"
+	}
+	if config.Delivery.MaxBackoff == "" {
+		config.Delivery.MaxBackoff = "10m"
+	}
+	if config.Processing.Workers == 0 {
+		config.Processing.Workers = 4
+	}
+	if config.Processing.QueueSize == 0 {
+		config.Processing.QueueSize = 1000
+	}
+	if config.Shutdown.Timeout == "" {
+		config.Shutdown.Timeout = "30s"
+	}
+	if config.Deduplication.TTL == "" {
+		config.Deduplication.TTL = "1h"
+	}
+	if config.Deduplication.Persist == nil {
+		persist := true
+		config.Deduplication.Persist = &persist
+	}
+	if config.Sessions.StaleTimeout == "" {
+		config.Sessions.StaleTimeout = "6h"
+	}
 }
 
-func readConfig(path string, logger lager.Logger) (Config, error) {
-	var config Config
-	if _, err := os.Stat(path); os.IsNotExist(err) {
-		logger.Info("create-config")
-		config = Config{
-			Port: 8080,
+// migrateLegacyFormats replaces the color and message of the filters with a rich format and reports whether any filter
+// changed.
+func migrateLegacyFormats(l domain.FilterList) bool {
+	migrated := false
+	for i, filter := range l {
+		if (filter.Color != "" || filter.Message != "") && (filter.Format == nil || filter.Format.Type == "") {
+			l[i].Format = &domain.Format{
+				Type: domain.FormatTypeRich,
+				Parameters: map[string]interface{}{
+					"color":   string(filter.Color),
+					"message": filter.Message,
+				},
+			}
+			l[i].Color = ""
+			l[i].Message = ""
+			migrated = true
 		}
-	} else {
-		logger.Info("read-existing-config")
-		c, err := os.ReadFile(path)
-		if err != nil {
-			return Config{}, err
+	}
+	return migrated
+}
+
+func migrateInclusiveComparators(l domain.RuleList) {
+	for i := range l {
+		switch l[i].Comparator {
+		case domain.ComparatorGreaterThan:
+			l[i].Comparator = domain.ComparatorGreaterThanOrEqual
+		case domain.ComparatorLessThan:
+			l[i].Comparator = domain.ComparatorLessThanOrEqual
 		}
-		err = json.Unmarshal(c, &config)
-		if err != nil {
-			return Config{}, err
+		migrateInclusiveComparators(l[i].All)
+		migrateInclusiveComparators(l[i].Any)
+		if l[i].Not != nil {
+			not := domain.RuleList{*l[i].Not}
+			migrateInclusiveComparators(not)
+			l[i].Not = &not[0]
+		}
+	}
+}
+
+// Retention returns the retention policy of the history.
+func (h History) Retention() domain.RetentionPolicy {
+	maxAge, _ := time.ParseDuration(h.MaxAge)
+	p := domain.RetentionPolicy{
+		Default:    domain.Retention{MaxEventsPerPlayer: h.MaxEventsPerPlayer, MaxAge: maxAge},
+		EventTypes: map[string]domain.Retention{},
+	}
+	for eventType, r := range h.EventTypes {
+		retention := p.Default
+		if r.MaxEventsPerPlayer != 0 {
+			retention.MaxEventsPerPlayer = r.MaxEventsPerPlayer
+		}
+		if r.MaxAge != "" {
+			retention.MaxAge, _ = time.ParseDuration(r.MaxAge)
 		}
+		p.EventTypes[eventType] = retention
+	}
+	return p
+}
+
+func (d Delivery) RetryBackoff() (initial, max time.Duration) {
+	initial, _ = time.ParseDuration(d.InitialBackoff)
+	max, _ = time.ParseDuration(d.MaxBackoff)
+	return initial, max
+}
+
+func (d Deduplication) Duration() time.Duration {
+	ttl, _ := time.ParseDuration(d.TTL)
+	return ttl
+}
+
+func (s Sessions) StaleAfter() time.Duration {
+	d, _ := time.ParseDuration(s.StaleTimeout)
+	return d
+}
+
+func (s Shutdown) Duration() time.Duration {
+	timeout, _ := time.ParseDuration(s.Timeout)
+	return timeout
+}
+
+func readConfig(path string, logger lager.Logger) (Config, error) {
+	logger.Info("read-existing-config")
+	var config Config
+	c, err := os.ReadFile(path)
+	if err != nil {
+		return Config{}, err
+	}
+	d := json.NewDecoder(bytes.NewReader(c))
+	d.UseNumber()
+	err = d.Decode(&config)
+	if err != nil {
+		return Config{}, err
 	}
 	return config, nil
 }
@@ -96,5 +401,12 @@ func persistConfig(path string, config Config) error {
 	if err != nil {
 		return err
 	}
-	return os.WriteFile(path, c, 0655)
+	return writeConfig(path, c)
+}
+
+func writeConfig(path string, c []byte) error {
+	if err := os.WriteFile(path, c, 0600); err != nil {
+		return err
+	}
+	return os.Chmod(path, 0600)
 }
@@ -0,0 +1,524 @@
+package internal_test
+
+import (
+	"cftools-relay/internal"
+	"cftools-relay/internal/domain"
+	"code.cloudfoundry.org/lager"
+	"encoding/json"
+	"errors"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+var _ = Describe("Config", func() {
+	var (
+		tmpPath string
+		logger  lager.Logger
+	)
+
+	BeforeEach(func() {
+		path, err := os.MkdirTemp("", "test-config")
+		if err != nil {
+			panic(err)
+		}
+		tmpPath = path
+		logger = lager.NewLogger("test")
+	})
+
+	AfterEach(func() {
+		err := os.RemoveAll(tmpPath)
+		if err != nil {
+			panic(err)
+		}
+	})
+
+	loadConfig := func(content string) (internal.Config, error) {
+		path := filepath.Join(tmpPath, "config.json")
+		err := os.WriteFile(path, []byte(content), 0600)
+		Expect(err).ToNot(HaveOccurred())
+		return internal.NewConfig(path, logger)
+	}
+
+	eventWith := func(field string, value interface{}) domain.Event {
+		return domain.Event{
+			Type:      domain.EventPlayerKill,
+			Timestamp: time.Now(),
+			Values: map[string]interface{}{
+				domain.FieldMurdererCfToolsId: "AN_ID",
+				field:                         value,
+			},
+		}
+	}
+
+	Context("oneOf comparator", func() {
+		It("matches values of a JSON array of strings", func() {
+			c, err := loadConfig(`{"version": 2, "filter": [{"event": "player.kill", "rules": [{"comparator": "oneOf", "field": "weapon", "value": ["KA-M", "M16-A2"]}]}]}`)
+			Expect(err).ToNot(HaveOccurred())
+
+			matches, _, err := c.Filter.MatchingFilters(nil, eventWith("weapon", "M16-A2"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(matches).To(BeTrue())
+
+			matches, _, err = c.Filter.MatchingFilters(nil, eventWith("weapon", "IJ-70"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(matches).To(BeFalse())
+		})
+
+		It("matches values of a JSON array of numbers", func() {
+			c, err := loadConfig(`{"version": 2, "filter": [{"event": "player.kill", "rules": [{"comparator": "oneOf", "field": "distance", "value": [100, 2.5]}]}]}`)
+			Expect(err).ToNot(HaveOccurred())
+
+			for _, v := range []interface{}{json.Number("100"), json.Number("100.0"), 100, 100.0, json.Number("2.5"), 2.5} {
+				matches, _, err := c.Filter.MatchingFilters(nil, eventWith("distance", v))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(matches).To(BeTrue(), "expected %v (%T) to match", v, v)
+			}
+
+			matches, _, err := c.Filter.MatchingFilters(nil, eventWith("distance", json.Number("100.5")))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(matches).To(BeFalse())
+		})
+
+		It("matches Steam64 IDs without losing precision", func() {
+			c, err := loadConfig(`{"version": 2, "filter": [{"event": "player.kill", "rules": [{"comparator": "oneOf", "field": "player_steam64", "value": [76561198000000001, "76561198000000002"]}]}]}`)
+			Expect(err).ToNot(HaveOccurred())
+
+			for _, v := range []interface{}{"76561198000000001", json.Number("76561198000000001"), json.Number("76561198000000002")} {
+				matches, _, err := c.Filter.MatchingFilters(nil, eventWith("player_steam64", v))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(matches).To(BeTrue(), "expected %v (%T) to match", v, v)
+			}
+
+			matches, _, err := c.Filter.MatchingFilters(nil, eventWith("player_steam64", "76561198000000000"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(matches).To(BeFalse())
+		})
+	})
+
+	Context("validation", func() {
+		It("reports every problem with its path", func() {
+			_, err := loadConfig(`{
+				"version": 2,
+				"targets": {"default": {"type": "slack", "webhook_url": "https://discord.com/api/webhooks/1/a"}},
+				"filter": [
+					{"event": "user.join", "rules": null},
+					{
+						"event": "player.kill",
+						"targets": ["unknown"],
+						"format": {"type": "rich", "parameters": {"color": "PINK"}},
+						"rules": [
+							{"comparator": "gte", "field": "distance", "value": 100},
+							{"comparator": "greaterThan", "field": "distance", "value": 100},
+							{"any": [{"comparator": "gte", "field": "vf_event_count", "value": 5, "since": "1 hour"}]}
+						]
+					}
+				]
+			}`)
+
+			var problems internal.ValidationErrors
+			Expect(errors.As(err, &problems)).To(BeTrue())
+			Expect(problems).To(ConsistOf(
+				internal.ValidationError{Path: "targets.default.type", Message: `unknown "slack"`},
+				internal.ValidationError{Path: "filter[1].targets[0]", Message: `unknown target "unknown"`},
+				internal.ValidationError{Path: "filter[1].format.parameters.color", Message: `unknown "PINK"`},
+				internal.ValidationError{Path: "filter[1].rules[1].comparator", Message: `unknown "greaterThan"`},
+				internal.ValidationError{Path: "filter[1].rules[2].any[0].since", Message: `invalid duration "1 hour"`},
+			))
+		})
+
+		It("reports unknown event types of filters", func() {
+			_, err := loadConfig(`{"version": 2, "targets": {"default": {"type": "discord", "webhook_url": "https://discord.com/api/webhooks/1/a"}}, "filter": [
+				{"event": "player.kil"},
+				{"event": "player.kill"}
+			], "servers": {"pvp": {"filter": [{"event": "user.joined"}]}}}`)
+
+			var problems internal.ValidationErrors
+			Expect(errors.As(err, &problems)).To(BeTrue())
+			Expect(problems).To(ConsistOf(
+				internal.ValidationError{Path: "filter[0].event", Message: `unknown event type "player.kil"`},
+				internal.ValidationError{Path: "servers.pvp.filter[0].event", Message: `unknown event type "user.joined"`},
+			))
+		})
+
+		It("reports invalid values of comparators", func() {
+			_, err := loadConfig(`{"version": 2, "filter": [{"event": "player.kill", "rules": [
+				{"comparator": "gt", "field": "distance", "value": "far"},
+				{"comparator": "between", "field": "distance", "value": [1]},
+				{"comparator": "matches", "field": "weapon", "value": "(IJ"},
+				{"comparator": "eq", "field": "weapon"},
+				{"comparator": "exists", "field": "weapon"},
+				{"comparator": "eq", "field": "vf_unknown", "value": 1},
+				{"comparator": "gte", "field": "vf_event_count", "value": 1, "scope": "cluster"},
+				{"comparator": "eq", "field": "weapon", "value": "IJ-70", "scope": "server"}
+			]}]}`)
+
+			var problems internal.ValidationErrors
+			Expect(errors.As(err, &problems)).To(BeTrue())
+			Expect(problems).To(HaveLen(7))
+			Expect(problems[0].Error()).To(Equal(`filter[0].rules[0].value: expected a number, got "far"`))
+			Expect(problems[1].Error()).To(Equal(`filter[0].rules[1].value: expected a list of two numbers, got [1]`))
+			Expect(problems[2].Path).To(Equal("filter[0].rules[2].value"))
+			Expect(problems[3].Error()).To(Equal(`filter[0].rules[3].value: missing`))
+			Expect(problems[4].Error()).To(Equal(`filter[0].rules[5].field: unknown virtual field "vf_unknown"`))
+			Expect(problems[5].Error()).To(Equal(`filter[0].rules[6].scope: unknown "cluster", expected "server" or "global"`))
+			Expect(problems[6].Error()).To(Equal(`filter[0].rules[7].scope: only applies to virtual fields`))
+		})
+
+		It("reports invalid subjects", func() {
+			_, err := loadConfig(`{"version": 2, "filter": [{"event": "player.kill", "rules": [
+				{"comparator": "gte", "field": "vf_event_count", "value": 3, "subject": "witness"},
+				{"comparator": "eq", "field": "weapon", "value": "M4A1", "subject": "victim"},
+				{"comparator": "gte", "field": "vf_pair_event_count", "value": 3, "subject": "victim"}
+			]}]}`)
+
+			var problems internal.ValidationErrors
+			Expect(errors.As(err, &problems)).To(BeTrue())
+			Expect(problems).To(ConsistOf(
+				internal.ValidationError{Path: "filter[0].rules[0].subject", Message: `unknown "witness", expected "player", "victim" or "murderer"`},
+				internal.ValidationError{Path: "filter[0].rules[1].subject", Message: "only applies to virtual fields of a single player"},
+				internal.ValidationError{Path: "filter[0].rules[2].subject", Message: "only applies to virtual fields of a single player"},
+			))
+		})
+
+		It("reports empty groups of rules", func() {
+			_, err := loadConfig(`{"version": 2, "filter": [{"event": "player.kill", "rules": [
+				{"all": []},
+				{"any": []},
+				{"not": {"any": [{"all": []}]}}
+			]}]}`)
+
+			var problems internal.ValidationErrors
+			Expect(errors.As(err, &problems)).To(BeTrue())
+			Expect(problems).To(ConsistOf(
+				internal.ValidationError{Path: "filter[0].rules[0].all", Message: "expected at least one rule"},
+				internal.ValidationError{Path: "filter[0].rules[1].any", Message: "expected at least one rule"},
+				internal.ValidationError{Path: "filter[0].rules[2].not.any[0].all", Message: "expected at least one rule"},
+			))
+		})
+
+		It("reports source fields of rules, which are missing or do not apply", func() {
+			_, err := loadConfig(`{"version": 2, "filter": [{"event": "player.kill", "rules": [
+				{"comparator": "gt", "field": "vf_avg", "value": 400},
+				{"comparator": "gt", "field": "vf_event_count", "value": 3, "source_field": "distance", "source_event": "player.damage"},
+				{"comparator": "gt", "field": "vf_sum", "value": 500, "source_field": "damage", "source_event": "player.damage"}
+			]}]}`)
+
+			var problems internal.ValidationErrors
+			Expect(errors.As(err, &problems)).To(BeTrue())
+			Expect(problems).To(ConsistOf(
+				internal.ValidationError{Path: "filter[0].rules[0].source_field", Message: "missing, required by vf_avg"},
+				internal.ValidationError{Path: "filter[0].rules[1].source_field", Message: "only applies to aggregate virtual fields"},
+				internal.ValidationError{Path: "filter[0].rules[1].source_event", Message: "only applies to aggregate virtual fields"},
+			))
+		})
+
+		It("reports invalid zones and unknown zones of rules", func() {
+			_, err := loadConfig(`{"version": 2, "zones": {
+				"trader": {"center": [4000], "radius": 0},
+				"base": {"polygon": [[0, 0], [100, 0]]},
+				"both": {"center": [0, 0], "radius": 10, "polygon": [[0, 0], [1, 0], [1, 1]]}
+			}, "filter": [{"event": "player.kill", "rules": [
+				{"comparator": "withinZone", "field": "victim_position", "value": ["trader", "airfield"]},
+				{"comparator": "withinZone", "field": "victim_position", "value": 5}
+			]}]}`)
+
+			var problems internal.ValidationErrors
+			Expect(errors.As(err, &problems)).To(BeTrue())
+			Expect(problems).To(ConsistOf(
+				internal.ValidationError{Path: "zones.base.polygon", Message: "expected at least 3 corners, got 2"},
+				internal.ValidationError{Path: "zones.both", Message: "expected either center and radius or polygon"},
+				internal.ValidationError{Path: "zones.trader.center", Message: "expected X and Y, got 1 coordinates"},
+				internal.ValidationError{Path: "zones.trader.radius", Message: "expected a positive number, got 0"},
+				internal.ValidationError{Path: "filter[0].rules[0].value", Message: `unknown zone "airfield"`},
+				internal.ValidationError{Path: "filter[0].rules[1].value", Message: "expected the name or a list of names of zones, got 5"},
+			))
+		})
+
+		It("resolves the zones of rules", func() {
+			c, err := loadConfig(`{"version": 2, "targets": {"default": {"type": "discord", "webhook_url": "https://discord.com/api/webhooks/1/a"}}, "zones": {"trader": {"center": [4000, 9000], "radius": 150}}, "servers": {"pvp": {"secret": "abc", "filter": [
+				{"event": "player.kill", "rules": [{"comparator": "withinZone", "field": "victim_position", "value": "trader"}]}
+			]}}}`)
+			Expect(err).ToNot(HaveOccurred())
+
+			e := domain.Event{Type: domain.EventPlayerKill, Timestamp: time.Now(), Values: map[string]interface{}{
+				domain.FieldMurdererCfToolsId: "AN_ID",
+				"victim_position":             "<X: 4055.42, Y: 8895.48, Z: 324.61>",
+			}}
+			e.ParsePositions()
+			m, _, err := c.Servers["pvp"].Filter.MatchingFilters(nil, e)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(m).To(BeTrue())
+		})
+
+		It("reports invalid schedules", func() {
+			_, err := loadConfig(`{"version": 2, "filter": [{"event": "player.place", "schedule": {
+				"time_zone": "Mars/Olympus_Mons",
+				"weekdays": ["friday", "someday"],
+				"times": [{"from": "2am", "to": "06:00"}, {"from": "22:00", "to": "22:00"}]
+			}}]}`)
+
+			var problems internal.ValidationErrors
+			Expect(errors.As(err, &problems)).To(BeTrue())
+			Expect(problems).To(ConsistOf(
+				internal.ValidationError{Path: "filter[0].schedule.time_zone", Message: `unknown "Mars/Olympus_Mons"`},
+				internal.ValidationError{Path: "filter[0].schedule.weekdays[1]", Message: `unknown "someday", expected a weekday like "monday"`},
+				internal.ValidationError{Path: "filter[0].schedule.times[0].from", Message: `expected a time like 15:04, got "2am"`},
+				internal.ValidationError{Path: "filter[0].schedule.times[1]", Message: "expected different times for from and to, got 22:00"},
+			))
+		})
+
+		It("reports filters with the same name", func() {
+			_, err := loadConfig(`{"version": 2, "filter": [{"name": "kills", "event": "player.kill"}, {"name": "kills", "event": "player.kill"}]}`)
+
+			var problems internal.ValidationErrors
+			Expect(errors.As(err, &problems)).To(BeTrue())
+			Expect(problems).To(ConsistOf(
+				internal.ValidationError{Path: "filter[1].name", Message: `duplicate name "kills"`},
+			))
+		})
+
+		It("validates the filters and targets of servers", func() {
+			_, err := loadConfig(`{"version": 2, "servers": {"pvp": {"secret": "abc", "targets": ["killfeed"], "filter": [
+				{"name": "kills", "event": "player.kill", "rules": [{"comparator": "greaterThan", "field": "distance", "value": 100}]}
+			]}}, "filter": [{"name": "kills", "event": "player.kill"}]}`)
+
+			var problems internal.ValidationErrors
+			Expect(errors.As(err, &problems)).To(BeTrue())
+			Expect(problems).To(ConsistOf(
+				internal.ValidationError{Path: "servers.pvp.targets[0]", Message: `unknown target "killfeed"`},
+				internal.ValidationError{Path: "servers.pvp.filter[0].name", Message: `duplicate name "kills"`},
+				internal.ValidationError{Path: "servers.pvp.filter[0].rules[0].comparator", Message: `unknown "greaterThan"`},
+			))
+		})
+
+		It("reports filters and servers relaying to a default target, which is not configured", func() {
+			_, err := loadConfig(`{"version": 2, "targets": {"killfeed": {"type": "discord", "webhook_url": "https://discord.com/api/webhooks/1/a"}},
+				"servers": {
+					"pvp": {"secret": "abc", "filter": [{"event": "player.kill"}, {"event": "user.chat", "targets": ["killfeed"]}]},
+					"pve": {"secret": "def", "ignore_global_filter": true},
+					"event": {"secret": "ghi", "targets": ["killfeed"]}
+				},
+				"filter": [{"event": "user.join"}, {"event": "user.leave", "targets": ["killfeed"]}]
+			}`)
+
+			var problems internal.ValidationErrors
+			Expect(errors.As(err, &problems)).To(BeTrue())
+			Expect(problems).To(ConsistOf(
+				internal.ValidationError{Path: "servers.pve.targets", Message: `missing, events are relayed to the "default" target, which is not configured`},
+				internal.ValidationError{Path: "filter[0].targets", Message: `missing, events of server "pvp" are relayed to the "default" target, which is not configured`},
+				internal.ValidationError{Path: "servers.pvp.filter[0].targets", Message: `missing, events are relayed to the "default" target, which is not configured`},
+			))
+		})
+
+		It("labels the filters of servers with their path", func() {
+			c, err := loadConfig(`{"version": 2, "targets": {"default": {"type": "discord", "webhook_url": "https://discord.com/api/webhooks/1/a"}}, "servers": {"pvp": {"secret": "abc", "filter": [{"event": "player.kill"}]}}}`)
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(c.Servers["pvp"].Filter[0].Label()).To(Equal("servers.pvp.filter[0]"))
+		})
+
+		It("reports webhook URLs, which are missing or not absolute http(s) URLs", func() {
+			_, err := loadConfig(`{"version": 2, "targets": {
+				"default": {"type": "discord", "webhook_url": "https://discord.com/api/webhooks/1/a"},
+				"empty": {"type": "discord", "webhook_url": ""},
+				"missing": {"type": "discord"},
+				"relative": {"type": "discord", "webhook_url": "/api/webhooks/1/a"},
+				"scheme": {"type": "discord", "webhook_url": "ftp://discord.com/api/webhooks/1/a"}
+			}}`)
+
+			var problems internal.ValidationErrors
+			Expect(errors.As(err, &problems)).To(BeTrue())
+			Expect(problems).To(ConsistOf(
+				internal.ValidationError{Path: "targets.empty.webhook_url", Message: "missing"},
+				internal.ValidationError{Path: "targets.missing.webhook_url", Message: "missing"},
+				internal.ValidationError{Path: "targets.relative.webhook_url", Message: `expected an absolute http(s) URL, got "/api/webhooks/1/a"`},
+				internal.ValidationError{Path: "targets.scheme.webhook_url", Message: `expected an absolute http(s) URL, got "ftp://discord.com/api/webhooks/1/a"`},
+			))
+		})
+
+		It("reports an unknown history driver", func() {
+			_, err := loadConfig(`{"version": 2, "history": {"driver": "postgres"}}`)
+
+			var problems internal.ValidationErrors
+			Expect(errors.As(err, &problems)).To(BeTrue())
+			Expect(problems).To(ConsistOf(
+				internal.ValidationError{Path: "history.driver", Message: `unknown "postgres", expected "file" or "sqlite"`},
+			))
+		})
+
+		It("reports a deduplication ttl, which is not positive", func() {
+			_, err := loadConfig(`{"version": 2, "deduplication": {"ttl": "0s"}}`)
+
+			var problems internal.ValidationErrors
+			Expect(errors.As(err, &problems)).To(BeTrue())
+			Expect(problems).To(ConsistOf(
+				internal.ValidationError{Path: "deduplication.ttl", Message: `expected a positive duration, got "0s"`},
+			))
+		})
+
+		It("reports a session stale timeout, which is not positive", func() {
+			_, err := loadConfig(`{"version": 2, "sessions": {"stale_timeout": "-1h"}}`)
+
+			var problems internal.ValidationErrors
+			Expect(errors.As(err, &problems)).To(BeTrue())
+			Expect(problems).To(ConsistOf(
+				internal.ValidationError{Path: "sessions.stale_timeout", Message: `expected a positive duration, got "-1h"`},
+			))
+		})
+
+		It("reports a queue smaller than the worker pool", func() {
+			_, err := loadConfig(`{"version": 2, "processing": {"workers": 8, "queue_size": 4}}`)
+
+			var problems internal.ValidationErrors
+			Expect(errors.As(err, &problems)).To(BeTrue())
+			Expect(problems).To(ConsistOf(
+				internal.ValidationError{Path: "processing.queue_size", Message: "expected at least the number of workers (8), got 4"},
+			))
+		})
+
+		It("reports invalid history retention settings", func() {
+			_, err := loadConfig(`{"version": 2, "history": {"max_events_per_player": -1, "event_types": {"player.kill": {"max_age": "a day"}}}}`)
+
+			var problems internal.ValidationErrors
+			Expect(errors.As(err, &problems)).To(BeTrue())
+			Expect(problems).To(HaveLen(2))
+			Expect(problems[0].Path).To(Equal("history.max_events_per_player"))
+			Expect(problems[1].Path).To(Equal("history.event_types.player.kill.max_age"))
+		})
+
+		It("accepts a valid config", func() {
+			_, err := loadConfig(`{"version": 2, "filter": [{"event": "user.chat", "format": {"type": "text", "parameters": {"template": "{{.message}}"}}, "rules": [{"comparator": "matches", "field": "message", "value": "(?i)cheat"}]}]}`)
+			Expect(err).ToNot(HaveOccurred())
+		})
+	})
+
+	Context("history retention", func() {
+		It("inherits unset settings of event types from the defaults", func() {
+			c, err := loadConfig(`{"version": 2, "history": {"max_age": "720h", "event_types": {"player.kill": {"max_events_per_player": 500}}}}`)
+			Expect(err).ToNot(HaveOccurred())
+
+			r := c.History.Retention()
+			Expect(r.For(domain.EventUserJoin)).To(Equal(domain.Retention{MaxEventsPerPlayer: 100, MaxAge: 720 * time.Hour}))
+			Expect(r.For(domain.EventPlayerKill)).To(Equal(domain.Retention{MaxEventsPerPlayer: 500, MaxAge: 720 * time.Hour}))
+		})
+
+		It("warns about rules, which need more events than the history keeps", func() {
+			c, err := loadConfig(`{"version": 2, "history": {"max_age": "1h"}, "filter": [{"event": "player.kill", "rules": [{"comparator": "gt", "field": "vf_event_count", "value": 100, "since": "2h"}]}]}`)
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(c.Warnings()).To(ConsistOf(
+				internal.ValidationError{Path: "filter[0].rules[0].since", Message: "2h0m0s exceeds the max_age of the history of player.kill events (1h0m0s), older events are not counted"},
+				internal.ValidationError{Path: "filter[0].rules[0].value", Message: "needs 101 events, but the history keeps 100 player.kill events per player and server only"},
+			))
+		})
+
+		It("warns about aggregate and kill streak rules with the retention of the events they are evaluated with", func() {
+			c, err := loadConfig(`{"version": 2, "history": {"event_types": {"player.damage": {"max_age": "1h", "max_events_per_player": 10}, "player.kill": {"max_age": "2h"}}}, "filter": [{"event": "player.kill", "rules": [
+				{"comparator": "gt", "field": "vf_sum", "source_field": "damage", "source_event": "player.damage", "since": "90m", "value": 500},
+				{"comparator": "gte", "field": "vf_distinct_count", "source_field": "weapon", "source_event": "player.damage", "value": 20},
+				{"comparator": "gte", "field": "vf_kill_streak", "since": "3h", "value": 5},
+				{"comparator": "gte", "field": "vf_kill_streak", "value": 5}
+			]}]}`)
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(c.Warnings()).To(ConsistOf(
+				internal.ValidationError{Path: "filter[0].rules[0].since", Message: "1h30m0s exceeds the max_age of the history of player.damage events (1h0m0s), older events are not counted"},
+				internal.ValidationError{Path: "filter[0].rules[1].value", Message: "needs 20 events, but the history keeps 10 player.damage events per player and server only"},
+				internal.ValidationError{Path: "filter[0].rules[2].since", Message: "3h0m0s exceeds the max_age of the history of player.kill events (2h0m0s), older events are not counted"},
+			))
+		})
+
+		It("does not warn about rules within the retention", func() {
+			c, err := loadConfig(`{"version": 2, "filter": [{"event": "player.kill", "rules": [{"comparator": "gte", "field": "vf_event_count", "value": 100, "since": "24h"}]}]}`)
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(c.Warnings()).To(BeEmpty())
+		})
+	})
+
+	Context("persistence", func() {
+		legacy := `{"secret": "abc", "discord": {"webhook_url": "http://example.com"}, "filter": [{"event": "player.kill", "color": "RED", "rules": [{"comparator": "gt", "field": "distance", "value": 100}]}]}`
+
+		It("creates a default config when none exists, which needs a webhook URL", func() {
+			path := filepath.Join(tmpPath, "config.json")
+
+			c, err := internal.NewConfig(path, logger)
+
+			var problems internal.ValidationErrors
+			Expect(errors.As(err, &problems)).To(BeTrue())
+			Expect(problems).To(ConsistOf(internal.ValidationError{Path: "targets.default.webhook_url", Message: "missing"}))
+			Expect(c.Targets).To(HaveKey(domain.DefaultTarget))
+			info, err := os.Stat(path)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(info.Mode().Perm()).To(Equal(os.FileMode(0600)))
+		})
+
+		It("does not rewrite an existing config", func() {
+			c, err := loadConfig(legacy)
+
+			Expect(err).ToNot(HaveOccurred())
+			Expect(c.Servers).To(HaveKey(""))
+			Expect(c.Targets[domain.DefaultTarget].WebhookUrl).To(Equal("http://example.com"))
+			Expect(c.Filter[0].Rules[0].Comparator).To(Equal(domain.ComparatorGreaterThanOrEqual))
+			content, err := os.ReadFile(filepath.Join(tmpPath, "config.json"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(content)).To(Equal(legacy))
+		})
+
+		It("migrates the filters of servers of a legacy config", func() {
+			c, err := loadConfig(`{"targets": {"default": {"type": "discord", "webhook_url": "https://discord.com/api/webhooks/1/a"}}, "servers": {"pvp": {"secret": "abc", "filter": [
+				{"event": "player.kill", "color": "RED", "message": "a kill", "rules": [{"comparator": "lt", "field": "distance", "value": 100}]}
+			]}}}`)
+
+			Expect(err).ToNot(HaveOccurred())
+			filter := c.Servers["pvp"].Filter[0]
+			Expect(filter.Rules[0].Comparator).To(Equal(domain.ComparatorLessThanOrEqual))
+			Expect(filter.Color).To(BeEmpty())
+			Expect(filter.Message).To(BeEmpty())
+			Expect(filter.Format.Type).To(Equal(domain.FormatTypeRich))
+			Expect(filter.Format.Parameters).To(HaveKeyWithValue("color", "RED"))
+			Expect(filter.Format.Parameters).To(HaveKeyWithValue("message", "a kill"))
+		})
+
+		It("migrates a legacy config and writes a backup", func() {
+			path := filepath.Join(tmpPath, "config.json")
+			Expect(os.WriteFile(path, []byte(legacy), 0644)).To(Succeed())
+
+			backup, err := internal.MigrateConfig(path, logger)
+
+			Expect(err).ToNot(HaveOccurred())
+			Expect(backup).To(HavePrefix(path + "."))
+			content, err := os.ReadFile(backup)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(content)).To(Equal(legacy))
+
+			info, err := os.Stat(path)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(info.Mode().Perm()).To(Equal(os.FileMode(0600)))
+			var migrated map[string]interface{}
+			content, err = os.ReadFile(path)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(json.Unmarshal(content, &migrated)).To(Succeed())
+			Expect(migrated).ToNot(HaveKey("secret"))
+			Expect(migrated).ToNot(HaveKey("discord"))
+			Expect(migrated).To(HaveKeyWithValue("version", BeNumerically("==", internal.ConfigVersion)))
+			Expect(migrated).To(HaveKey("servers"))
+			Expect(migrated).To(HaveKey("targets"))
+			for _, implicit := range []string{"port", "history", "delivery", "processing", "shutdown", "deduplication", "sessions"} {
+				Expect(migrated).ToNot(HaveKey(implicit))
+			}
+			c, err := internal.LoadConfig(path, logger)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(c.Filter[0].Rules[0].Comparator).To(Equal(domain.ComparatorGreaterThanOrEqual))
+			Expect(c.Filter[0].Format.Type).To(Equal(domain.FormatTypeRich))
+			Expect(c.Delivery.MaxAttempts).To(Equal(10))
+
+			backup, err = internal.MigrateConfig(path, logger)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(backup).To(BeEmpty())
+		})
+	})
+})
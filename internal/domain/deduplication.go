@@ -0,0 +1,8 @@
+package domain
+
+// Deduplicator remembers the IDs of webhook deliveries, which were processed already, so that deliveries retried by
+// CFTools are not relayed twice.
+type Deduplicator interface {
+	IsProcessed(id string) (bool, error)
+	MarkProcessed(id string) error
+}
@@ -7,7 +7,63 @@ import (
 
 var ErrCFToolsIdMissing = errors.New("CFTools ID is missing")
 
+// EventHistory stores events per server, which the event was received from (Event.Server), and per player involved in
+// the event (Event.CFToolsIds), e.g. a kill is stored for the murderer and the victim.
 type EventHistory interface {
 	Save(e Event) error
-	FindWithin(eventType, cftoolsId string, within time.Duration) ([]Event, error)
+	// FindWithin returns the events of the given type, which the player is involved in and which are not older than
+	// within. Only events of the given server are returned, or of all servers, if server is nil.
+	FindWithin(server *string, eventType, cftoolsId string, within time.Duration) ([]Event, error)
+}
+
+// Retention limits how many and how old events of a player are kept in the history.
+type Retention struct {
+	// MaxEventsPerPlayer is the number of events of the same type, which are kept per player and server.
+	MaxEventsPerPlayer int
+	// MaxAge is the age after which events are removed, events are kept forever if it is 0.
+	MaxAge time.Duration
+}
+
+type RetentionPolicy struct {
+	Default    Retention
+	EventTypes map[string]Retention
+}
+
+// For returns the retention of events of the given type.
+func (p RetentionPolicy) For(eventType string) Retention {
+	if r, ok := p.EventTypes[eventType]; ok {
+		return r
+	}
+	return p.Default
+}
+
+// Keep reports whether an event is kept, when n newer events of the same type and player exist.
+func (r Retention) Keep(e Event, n int, now time.Time) bool {
+	if r.MaxEventsPerPlayer > 0 && n >= r.MaxEventsPerPlayer {
+		return false
+	}
+	return r.MaxAge == 0 || !e.Timestamp.Before(now.Add(-r.MaxAge))
+}
+
+// Prune returns the events, which are kept according to the policy. events are expected to be sorted from the oldest to
+// the newest event, the order is preserved.
+func (p RetentionPolicy) Prune(events []Event, now time.Time) []Event {
+	newer := map[string]int{}
+	keep := make([]bool, len(events))
+	kept := 0
+	for i := len(events) - 1; i >= 0; i-- {
+		t := events[i].Type
+		keep[i] = p.For(t).Keep(events[i], newer[t], now)
+		newer[t]++
+		if keep[i] {
+			kept++
+		}
+	}
+	res := make([]Event, 0, kept)
+	for i, e := range events {
+		if keep[i] {
+			res = append(res, e)
+		}
+	}
+	return res
 }
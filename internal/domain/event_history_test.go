@@ -0,0 +1,46 @@
+package domain_test
+
+import (
+	"cftools-relay/internal/domain"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"time"
+)
+
+var _ = Describe("RetentionPolicy", func() {
+	now := time.Now()
+	event := func(t string, age time.Duration) domain.Event {
+		return domain.Event{Type: t, Timestamp: now.Add(-age)}
+	}
+
+	It("keeps the newest events of each type", func() {
+		p := domain.RetentionPolicy{
+			Default:    domain.Retention{MaxEventsPerPlayer: 2},
+			EventTypes: map[string]domain.Retention{domain.EventPlayerKill: {MaxEventsPerPlayer: 1}},
+		}
+		events := []domain.Event{
+			event(domain.EventUserJoin, 4*time.Minute),
+			event(domain.EventPlayerKill, 3*time.Minute),
+			event(domain.EventUserJoin, 2*time.Minute),
+			event(domain.EventPlayerKill, 1*time.Minute),
+			event(domain.EventUserJoin, 0),
+		}
+
+		Expect(p.Prune(events, now)).To(Equal([]domain.Event{events[2], events[3], events[4]}))
+	})
+
+	It("removes events older than the max age of their type", func() {
+		p := domain.RetentionPolicy{
+			Default:    domain.Retention{MaxEventsPerPlayer: 100, MaxAge: time.Hour},
+			EventTypes: map[string]domain.Retention{domain.EventPlayerKill: {MaxEventsPerPlayer: 100, MaxAge: 24 * time.Hour}},
+		}
+		events := []domain.Event{
+			event(domain.EventUserJoin, 2*time.Hour),
+			event(domain.EventPlayerKill, 2*time.Hour),
+			event(domain.EventPlayerKill, 25*time.Hour),
+			event(domain.EventUserJoin, 0),
+		}
+
+		Expect(p.Prune(events, now)).To(Equal([]domain.Event{events[1], events[3]}))
+	})
+})
@@ -2,20 +2,67 @@ package domain
 
 import (
 	"cftools-relay/internal/stringutil"
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"strconv"
 	"strings"
 	"time"
 )
 
 const (
-	ComparatorEquals      = "eq"
-	ComparatorGreaterThan = "gt"
-	ComparatorLessThan    = "lt"
-	ComparatorContains    = "contains"
-	ComparatorStartsWith  = "startsWith"
-	ComparatorEndsWith    = "endsWith"
-	ComparatorOneOf       = "oneOf"
+	ComparatorEquals             = "eq"
+	ComparatorNotEquals          = "neq"
+	ComparatorGreaterThan        = "gt"
+	ComparatorGreaterThanOrEqual = "gte"
+	ComparatorLessThan           = "lt"
+	ComparatorLessThanOrEqual    = "lte"
+	ComparatorBetween            = "between"
+	ComparatorContains           = "contains"
+	ComparatorStartsWith         = "startsWith"
+	ComparatorEndsWith           = "endsWith"
+	ComparatorOneOf              = "oneOf"
+	ComparatorNotOneOf           = "notOneOf"
+	ComparatorMatches            = "matches"
+	ComparatorExists             = "exists"
+	ComparatorMissing            = "missing"
+
+	ComparatorEqualsIgnoreCase     = "eqIgnoreCase"
+	ComparatorContainsIgnoreCase   = "containsIgnoreCase"
+	ComparatorStartsWithIgnoreCase = "startsWithIgnoreCase"
+	ComparatorEndsWithIgnoreCase   = "endsWithIgnoreCase"
+	ComparatorOneOfIgnoreCase      = "oneOfIgnoreCase"
+
+	// ComparatorWithinZone matches, when the position of the field is within one of the zones of the value.
+	ComparatorWithinZone = "withinZone"
 
 	VirtualFieldEventCount = "vf_event_count"
+	VirtualFieldKillStreak = "vf_kill_streak"
+	// VirtualFieldPairEventCount counts the events of the same murderer and victim.
+	VirtualFieldPairEventCount = "vf_pair_event_count"
+
+	// The aggregate virtual fields are evaluated with the values of the source field of the rule in the history.
+	VirtualFieldSum           = "vf_sum"
+	VirtualFieldAvg           = "vf_avg"
+	VirtualFieldMax           = "vf_max"
+	VirtualFieldMin           = "vf_min"
+	VirtualFieldDistinctCount = "vf_distinct_count"
+
+	// DefaultSince is the time frame of virtual fields of rules without since.
+	DefaultSince = 1 * time.Hour
+
+	// ScopeGlobal evaluates virtual fields with the events of all servers, ScopeServer with the events of the server
+	// the event was received from only.
+	ScopeGlobal = "global"
+	ScopeServer = "server"
+
+	// SubjectPlayer evaluates virtual fields for the player, who the event is mainly about (Event.CFToolsId), SubjectVictim
+	// and SubjectMurderer for the victim or murderer of the event.
+	SubjectPlayer   = "player"
+	SubjectVictim   = "victim"
+	SubjectMurderer = "murderer"
 
 	ColorAqua            = 1752220
 	ColorDarkAqua        = 1146986
@@ -80,21 +127,92 @@ var colorMapping = map[string]int{
 	"BLACK":              ColorBlack,
 }
 
+var comparators = map[string]bool{
+	ComparatorEquals:               true,
+	ComparatorNotEquals:            true,
+	ComparatorGreaterThan:          true,
+	ComparatorGreaterThanOrEqual:   true,
+	ComparatorLessThan:             true,
+	ComparatorLessThanOrEqual:      true,
+	ComparatorBetween:              true,
+	ComparatorContains:             true,
+	ComparatorStartsWith:           true,
+	ComparatorEndsWith:             true,
+	ComparatorOneOf:                true,
+	ComparatorNotOneOf:             true,
+	ComparatorMatches:              true,
+	ComparatorExists:               true,
+	ComparatorMissing:              true,
+	ComparatorEqualsIgnoreCase:     true,
+	ComparatorContainsIgnoreCase:   true,
+	ComparatorStartsWithIgnoreCase: true,
+	ComparatorEndsWithIgnoreCase:   true,
+	ComparatorOneOfIgnoreCase:      true,
+	ComparatorWithinZone:           true,
+}
+
+var virtualFields = map[string]bool{
+	VirtualFieldEventCount:     true,
+	VirtualFieldKillStreak:     true,
+	VirtualFieldPairEventCount: true,
+	VirtualFieldSum:            true,
+	VirtualFieldAvg:            true,
+	VirtualFieldMax:            true,
+	VirtualFieldMin:            true,
+	VirtualFieldDistinctCount:  true,
+
+	VirtualFieldSessionDuration: true,
+	VirtualFieldIsFirstJoin:     true,
+	VirtualFieldSessionsToday:   true,
+	VirtualFieldOnlineCount:     true,
+}
+
+func IsComparator(c string) bool {
+	return comparators[c]
+}
+
+func IsVirtualField(f string) bool {
+	return virtualFields[f]
+}
+
+func IsColor(c string) bool {
+	_, ok := colorMapping[c]
+	return ok
+}
+
 type FilterList []Filter
 
 func (l FilterList) MatchingFilters(h EventHistory, e Event) (bool, []Filter, error) {
+	m, matches, err := l.Matching(h, e)
 	var result []Filter
+	for _, match := range matches {
+		result = append(result, match.Filter)
+	}
+	return m, result, err
+}
+
+// Match is a filter, which matches an event, and the event with the virtual fields of the rules of the filter, which is
+// relayed for the filter.
+type Match struct {
+	Filter Filter
+	Event  Event
+}
+
+// Matching returns the filters, which match the event. Like with MatchingFilters, any event matches, if the list is
+// empty.
+func (l FilterList) Matching(h EventHistory, e Event) (bool, []Match, error) {
+	var result []Match
 	if len(l) == 0 {
 		return true, result, nil
 	}
 
 	for _, filter := range l {
-		m, err := filter.Matches(h, e)
+		m, fe, err := filter.Evaluate(h, e)
 		if err != nil {
 			return false, result, err
 		}
 		if m {
-			result = append(result, filter)
+			result = append(result, Match{Filter: filter, Event: fe})
 		}
 	}
 	return len(result) != 0, result, nil
@@ -111,12 +229,27 @@ func (c Color) Int() int {
 }
 
 type Filter struct {
+	Name     string   `json:"name,omitempty"`
 	Event    string   `json:"event"`
 	Rules    RuleList `json:"rules"`
 	Format   *Format  `json:"format,omitempty"`
 	Message  string   `json:"message,omitempty"`
 	Color    Color    `json:"color,omitempty"`
 	Username *string  `json:"username,omitempty"`
+	Targets  []string `json:"targets,omitempty"`
+	// Schedule limits the filter to the events, which are received at certain times.
+	Schedule *Schedule `json:"schedule,omitempty"`
+
+	label string
+}
+
+// Label identifies the filter, e.g. in metrics. It is the name of the filter or, if it has none, its position in the
+// list it was compiled with.
+func (f Filter) Label() string {
+	if f.Name != "" {
+		return f.Name
+	}
+	return f.label
 }
 
 type FormatType string
@@ -129,102 +262,634 @@ type Format struct {
 type RuleList []Rule
 
 type Rule struct {
-	Comparator string      `json:"comparator"`
-	Field      string      `json:"field"`
-	Value      interface{} `json:"value"`
+	Comparator string      `json:"comparator,omitempty"`
+	Field      string      `json:"field,omitempty"`
+	Value      interface{} `json:"value,omitempty"`
 	Since      string      `json:"since,omitempty"`
+	Scope      string      `json:"scope,omitempty"`
+	Subject    string      `json:"subject,omitempty"`
+	// SourceField is the field of the events, which aggregate virtual fields are evaluated with, of events of the type
+	// SourceEvent, or of the same type as the event if it is empty.
+	SourceField string   `json:"source_field,omitempty"`
+	SourceEvent string   `json:"source_event,omitempty"`
+	All         RuleList `json:"all,omitempty"`
+	Any         RuleList `json:"any,omitempty"`
+	Not         *Rule    `json:"not,omitempty"`
+
+	pattern *regexp.Regexp
+	zones   []Zone
 }
 
 func (f Filter) Matches(h EventHistory, e Event) (bool, error) {
-	if e.Type != f.Event {
-		return false, nil
+	m, _, err := f.Evaluate(h, e)
+	return m, err
+}
+
+// Evaluate reports whether the filter matches the event. The virtual fields are set in a copy of the event, which is
+// returned, so that the values of one filter do not show up in the messages of another. If the filter matches, the copy
+// has the virtual fields of all of its rules, even of those, which were not needed to decide the match.
+func (f Filter) Evaluate(h EventHistory, e Event) (bool, Event, error) {
+	if e.Type != f.Event || !f.Schedule.Active(e.Timestamp) {
+		return false, e, nil
 	}
-	if len(f.Rules) == 0 {
-		return true, nil
+	e = e.withCopiedValues()
+	m, err := f.Rules.MatchesAll(h, e)
+	if err != nil || !m {
+		return false, e, err
 	}
-	for _, rule := range f.Rules {
-		err := populateVirtualField(h, e, rule)
-		if err != nil {
+	return true, e, f.Rules.populateMissingVirtualFields(h, e)
+}
+
+// populateMissingVirtualFields sets the virtual fields of the rules, which are not set in the event yet, e.g. of the
+// rules of an any group after the first one that matched.
+func (l RuleList) populateMissingVirtualFields(h EventHistory, e Event) error {
+	for _, r := range l {
+		if IsVirtualField(r.Field) && !IsSessionField(r.Field) {
+			field := r.Field
+			if IsAggregateField(field) {
+				field = AggregateFieldName(r.Field, r.SourceField)
+			}
+			if _, ok := e.Values[field]; !ok {
+				if err := populateVirtualField(h, e, r); err != nil {
+					return err
+				}
+			}
+		}
+		if err := r.All.populateMissingVirtualFields(h, e); err != nil {
+			return err
+		}
+		if err := r.Any.populateMissingVirtualFields(h, e); err != nil {
+			return err
+		}
+		if r.Not != nil {
+			if err := (RuleList{*r.Not}).populateMissingVirtualFields(h, e); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (l RuleList) MatchesAll(h EventHistory, e Event) (bool, error) {
+	for _, rule := range l {
+		m, err := rule.Matches(h, e)
+		if err != nil || !m {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+func (l RuleList) MatchesAny(h EventHistory, e Event) (bool, error) {
+	for _, rule := range l {
+		m, err := rule.Matches(h, e)
+		if err != nil || m {
+			return m, err
+		}
+	}
+	return false, nil
+}
+
+func (r Rule) IsGroup() bool {
+	return r.All != nil || r.Any != nil || r.Not != nil
+}
+
+func (r Rule) Matches(h EventHistory, e Event) (bool, error) {
+	if !r.IsGroup() || r.Comparator != "" {
+		m, err := r.matchesField(h, e)
+		if err != nil || !m {
 			return false, err
 		}
-		v, ok := e.Values[rule.Field]
-		if !ok {
+	}
+	if r.All != nil {
+		m, err := r.All.MatchesAll(h, e)
+		if err != nil || !m {
+			return false, err
+		}
+	}
+	if r.Any != nil {
+		m, err := r.Any.MatchesAny(h, e)
+		if err != nil || !m {
+			return false, err
+		}
+	}
+	if r.Not != nil {
+		m, err := r.Not.Matches(h, e)
+		if err != nil || m {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+func (r Rule) matchesField(h EventHistory, e Event) (bool, error) {
+	err := populateVirtualField(h, e, r)
+	if err != nil {
+		return false, err
+	}
+	v, ok := e.Values[r.Field]
+	switch r.Comparator {
+	case ComparatorExists:
+		return ok, nil
+	case ComparatorMissing:
+		return !ok, nil
+	case ComparatorWithinZone:
+		// the zone is checked with the parsed coordinates of the position, see Event.ParsePositions.
+		return r.withinZone(e), nil
+	}
+	if !ok {
+		return false, nil
+	}
+	switch r.Comparator {
+	case ComparatorEquals:
+		return valuesEqual(v, r.Value), nil
+	case ComparatorNotEquals:
+		return !valuesEqual(v, r.Value), nil
+	case ComparatorContains:
+		return strings.Contains(stringutil.Itos(v), stringutil.Itos(r.Value)), nil
+	case ComparatorStartsWith:
+		return strings.HasPrefix(stringutil.Itos(v), stringutil.Itos(r.Value)), nil
+	case ComparatorEndsWith:
+		return strings.HasSuffix(stringutil.Itos(v), stringutil.Itos(r.Value)), nil
+	case ComparatorGreaterThan, ComparatorGreaterThanOrEqual, ComparatorLessThan, ComparatorLessThanOrEqual:
+		f, ok := numericValue(v)
+		limit, limitOk := numericValue(r.Value)
+		if !ok || !limitOk {
 			return false, nil
 		}
-		switch rule.Comparator {
-		case ComparatorEquals:
-			if v != rule.Value {
-				return false, nil
-			}
-		case ComparatorContains:
-			if !strings.Contains(stringutil.Itos(v), stringutil.Itos(rule.Value)) {
-				return false, nil
-			}
-		case ComparatorStartsWith:
-			if !strings.HasPrefix(stringutil.Itos(v), stringutil.Itos(rule.Value)) {
-				return false, nil
-			}
-		case ComparatorEndsWith:
-			if !strings.HasSuffix(stringutil.Itos(v), stringutil.Itos(rule.Value)) {
-				return false, nil
-			}
+		switch r.Comparator {
 		case ComparatorGreaterThan:
-			if stringutil.Itof(v) < stringutil.Itof(rule.Value) {
-				return false, nil
-			}
+			return f > limit, nil
+		case ComparatorGreaterThanOrEqual:
+			return f >= limit, nil
 		case ComparatorLessThan:
-			if stringutil.Itof(v) > stringutil.Itof(rule.Value) {
-				return false, nil
-			}
-		case ComparatorOneOf:
-			if !containsValue(v, rule.Value) {
-				return false, nil
-			}
-		default:
+			return f < limit, nil
+		}
+		return f <= limit, nil
+	case ComparatorBetween:
+		bounds := listValues(r.Value)
+		if len(bounds) != 2 {
 			return false, nil
 		}
+		f, ok := numericValue(v)
+		lower, lowerOk := numericValue(bounds[0])
+		upper, upperOk := numericValue(bounds[1])
+		return ok && lowerOk && upperOk && f >= lower && f <= upper, nil
+	case ComparatorOneOf:
+		return containsValue(v, r.Value), nil
+	case ComparatorNotOneOf:
+		return !containsValue(v, r.Value), nil
+	case ComparatorMatches:
+		p, err := r.compiledPattern()
+		if err != nil {
+			return false, err
+		}
+		return p.MatchString(stringutil.Itos(v)), nil
+	case ComparatorEqualsIgnoreCase:
+		return strings.EqualFold(stringutil.Itos(v), stringutil.Itos(r.Value)), nil
+	case ComparatorContainsIgnoreCase:
+		return strings.Contains(strings.ToLower(stringutil.Itos(v)), strings.ToLower(stringutil.Itos(r.Value))), nil
+	case ComparatorStartsWithIgnoreCase:
+		return strings.HasPrefix(strings.ToLower(stringutil.Itos(v)), strings.ToLower(stringutil.Itos(r.Value))), nil
+	case ComparatorEndsWithIgnoreCase:
+		return strings.HasSuffix(strings.ToLower(stringutil.Itos(v)), strings.ToLower(stringutil.Itos(r.Value))), nil
+	case ComparatorOneOfIgnoreCase:
+		return containsValueIgnoreCase(v, r.Value), nil
 	}
-	return true, nil
+	return false, nil
 }
 
-func (f Filter) SendingUsername() string {
-	if f.Username == nil {
+func (r Rule) compiledPattern() (*regexp.Regexp, error) {
+	if r.pattern != nil {
+		return r.pattern, nil
+	}
+	return regexp.Compile(stringutil.Itos(r.Value))
+}
+
+// Compile prepares all rules of the filters for matching, e.g. by compiling the regular expressions of the rules once.
+func (l FilterList) Compile() error {
+	return l.CompileAs("filter")
+}
+
+// CompileAs is like Compile, but the filters are labeled with the given path of the list in the config, e.g.
+// servers.pvp.filter.
+func (l FilterList) CompileAs(path string) error {
+	for i := range l {
+		l[i].label = fmt.Sprintf("%s[%d]", path, i)
+		if err := l[i].Rules.Compile(); err != nil {
+			return fmt.Errorf("%s %d: %w", path, i, err)
+		}
+		if err := l[i].Schedule.compile(); err != nil {
+			return fmt.Errorf("%s %d: invalid schedule: %w", path, i, err)
+		}
+	}
+	return nil
+}
+
+func (l RuleList) Compile() error {
+	for i := range l {
+		if err := l[i].compile(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *Rule) compile() error {
+	if r.Comparator == ComparatorMatches {
+		p, err := regexp.Compile(stringutil.Itos(r.Value))
+		if err != nil {
+			return fmt.Errorf("invalid pattern for field %s: %w", r.Field, err)
+		}
+		r.pattern = p
+	}
+	if err := r.All.Compile(); err != nil {
+		return err
+	}
+	if err := r.Any.Compile(); err != nil {
+		return err
+	}
+	if r.Not != nil {
+		return r.Not.compile()
+	}
+	return nil
+}
+
+func (f *Filter) SendingUsername() string {
+	if f == nil || f.Username == nil {
 		return "CFTools-Relay"
 	}
 	return *f.Username
 }
 
 func containsValue(v interface{}, values interface{}) bool {
-	switch x := values.(type) {
-	case []string:
-		for _, i := range x {
-			if v == i {
-				return true
-			}
+	list := listValues(values)
+	if list == nil {
+		return valuesEqual(v, values)
+	}
+	for _, i := range list {
+		if valuesEqual(v, i) {
+			return true
 		}
-	case string:
-		return v == x
 	}
 	return false
 }
 
+func containsValueIgnoreCase(v interface{}, values interface{}) bool {
+	list := listValues(values)
+	if list == nil {
+		list = []interface{}{values}
+	}
+	for _, i := range list {
+		if strings.EqualFold(stringutil.Itos(v), stringutil.Itos(i)) {
+			return true
+		}
+	}
+	return false
+}
+
+func listValues(v interface{}) []interface{} {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Slice && rv.Kind() != reflect.Array {
+		return nil
+	}
+	res := make([]interface{}, rv.Len())
+	for i := range res {
+		res[i] = rv.Index(i).Interface()
+	}
+	return res
+}
+
+// valuesEqual compares two values of an event or a rule. Numbers are compared by their value, no matter if they were
+// decoded as json.Number, float or int. A number equals a string, if the string is the decimal notation of it, which
+// allows to compare e.g. Steam64 IDs configured as numbers with IDs sent as strings.
+func valuesEqual(a, b interface{}) bool {
+	na, aNumeric := normalizeNumber(a)
+	nb, bNumeric := normalizeNumber(b)
+	if aNumeric && bNumeric {
+		return na == nb
+	}
+	if aNumeric {
+		if s, ok := b.(string); ok {
+			return formatNumber(na) == s
+		}
+		return false
+	}
+	if bNumeric {
+		if s, ok := a.(string); ok {
+			return formatNumber(nb) == s
+		}
+		return false
+	}
+	if a == nil || b == nil || !reflect.TypeOf(a).Comparable() || !reflect.TypeOf(b).Comparable() {
+		return a == nil && b == nil
+	}
+	return a == b
+}
+
+func normalizeNumber(v interface{}) (interface{}, bool) {
+	switch x := v.(type) {
+	case json.Number:
+		if i, err := x.Int64(); err == nil {
+			return i, true
+		}
+		if f, err := x.Float64(); err == nil {
+			return normalizeFloat(f), true
+		}
+	case float64:
+		return normalizeFloat(x), true
+	case float32:
+		return normalizeFloat(float64(x)), true
+	case int:
+		return int64(x), true
+	case int32:
+		return int64(x), true
+	case int64:
+		return x, true
+	}
+	return nil, false
+}
+
+// numericValue returns the value of a number or of the decimal notation of a number in a string. It reports false for
+// any other value, e.g. a text or a boolean.
+func numericValue(v interface{}) (float64, bool) {
+	if s, ok := v.(string); ok {
+		f, err := strconv.ParseFloat(s, 64)
+		return f, err == nil
+	}
+	n, ok := normalizeNumber(v)
+	if !ok {
+		return 0, false
+	}
+	return toFloat(n), true
+}
+
+func normalizeFloat(f float64) interface{} {
+	if f == math.Trunc(f) && math.Abs(f) < 1<<53 {
+		return int64(f)
+	}
+	return f
+}
+
+func formatNumber(v interface{}) string {
+	switch x := v.(type) {
+	case int64:
+		return strconv.FormatInt(x, 10)
+	case float64:
+		return strconv.FormatFloat(x, 'f', -1, 64)
+	}
+	return ""
+}
+
+// IsScope reports whether s is a valid scope of a rule, an empty scope is the same as ScopeGlobal.
+func IsScope(s string) bool {
+	return s == "" || s == ScopeGlobal || s == ScopeServer
+}
+
+// historyServer returns the server, which the history is limited to when evaluating a virtual field of the rule.
+func (r Rule) historyServer(e Event) *string {
+	if r.Scope == ScopeServer {
+		return &e.Server
+	}
+	return nil
+}
+
+// IsSubject reports whether s is a valid subject of a rule, an empty subject is the same as SubjectPlayer.
+func IsSubject(s string) bool {
+	return s == "" || s == SubjectPlayer || s == SubjectVictim || s == SubjectMurderer
+}
+
+// subjectField returns the field with the CFTools ID of the subject, or an empty string for the main player of the event.
+func subjectField(subject string) string {
+	switch subject {
+	case SubjectVictim:
+		return FieldVictimCfToolsId
+	case SubjectMurderer:
+		return FieldMurdererCfToolsId
+	}
+	return ""
+}
+
+// subjectId returns the CFTools ID of the subject in the event, or nil if the event does not have the subject.
+func subjectId(e Event, subject string) *string {
+	field := subjectField(subject)
+	if field == "" {
+		return e.CFToolsId()
+	}
+	if id, ok := e.Values[field].(string); ok {
+		return &id
+	}
+	return nil
+}
+
+// populateVirtualField sets the virtual field of the rule in the event. The value is evaluated for every rule, as rules
+// with the same field may differ in their since, scope and subject. The field is removed, if the event does not have the
+// subject of the rule. Session virtual fields are set by the SessionTracker before.
 func populateVirtualField(h EventHistory, e Event, rule Rule) error {
-	if _, ok := e.Values[VirtualFieldEventCount]; rule.Field == VirtualFieldEventCount && !ok {
-		var d time.Duration
-		if rule.Since != "" {
-			parsed, err := time.ParseDuration(rule.Since)
-			if err != nil {
-				return err
+	if IsVirtualField(rule.Field) && !IsSessionField(rule.Field) {
+		delete(e.Values, rule.Field)
+	}
+	switch rule.Field {
+	case VirtualFieldEventCount:
+		d, err := rule.since(DefaultSince)
+		if err != nil {
+			return err
+		}
+		id := subjectId(e, rule.Subject)
+		if id == nil {
+			return nil
+		}
+		events, err := h.FindWithin(rule.historyServer(e), e.Type, *id, d)
+		if err != nil {
+			return err
+		}
+		// the history contains the events, which the player is involved in, only the events with the player as the
+		// subject are counted.
+		count := 0
+		for _, event := range events {
+			if other := subjectId(event, rule.Subject); other != nil && *other == *id {
+				count++
 			}
-			d = parsed
-		} else {
-			d = 1 * time.Hour
 		}
-		events, err := h.FindWithin(e.Type, *e.CFToolsId(), d)
+		e.Values[VirtualFieldEventCount] = count
+	case VirtualFieldPairEventCount:
+		d, err := rule.since(DefaultSince)
 		if err != nil {
 			return err
 		}
-		e.Values[VirtualFieldEventCount] = len(events)
+		murderer, victim := subjectId(e, SubjectMurderer), subjectId(e, SubjectVictim)
+		if murderer == nil || victim == nil {
+			return nil
+		}
+		events, err := h.FindWithin(rule.historyServer(e), e.Type, *murderer, d)
+		if err != nil {
+			return err
+		}
+		count := 0
+		for _, event := range events {
+			if event.Values[FieldMurdererCfToolsId] == *murderer && event.Values[FieldVictimCfToolsId] == *victim {
+				count++
+			}
+		}
+		e.Values[VirtualFieldPairEventCount] = count
+	case VirtualFieldKillStreak:
+		// without since, the kill streak is evaluated with the whole history.
+		d, err := rule.since(time.Since(time.Unix(0, 0)))
+		if err != nil {
+			return err
+		}
+		id := subjectId(e, rule.Subject)
+		if id == nil {
+			return nil
+		}
+		streak, err := killStreak(h, rule.historyServer(e), *id, d)
+		if err != nil {
+			return err
+		}
+		e.Values[VirtualFieldKillStreak] = streak
+	default:
+		if IsAggregateField(rule.Field) {
+			return populateAggregateField(h, e, rule)
+		}
+	}
+	return nil
+}
+
+// IsAggregateField reports whether f is a virtual field, which aggregates the values of a source field.
+func IsAggregateField(f string) bool {
+	switch f {
+	case VirtualFieldSum, VirtualFieldAvg, VirtualFieldMax, VirtualFieldMin, VirtualFieldDistinctCount:
+		return true
+	}
+	return false
+}
+
+// AggregateFieldName returns the name of the field, which the value of an aggregate virtual field is additionally set
+// to, e.g. vf_avg_distance. This way, templates can use the values of more than one rule with the same field.
+func AggregateFieldName(field, sourceField string) string {
+	return field + "_" + sourceField
+}
+
+// populateAggregateField sets the aggregate virtual field of the rule in the event. vf_avg, vf_max and vf_min are not
+// set, if the history does not have any numeric value of the source field.
+func populateAggregateField(h EventHistory, e Event, rule Rule) error {
+	delete(e.Values, AggregateFieldName(rule.Field, rule.SourceField))
+	d, err := rule.since(DefaultSince)
+	if err != nil {
+		return err
+	}
+	id := subjectId(e, rule.Subject)
+	if id == nil {
+		return nil
+	}
+	eventType := rule.SourceEvent
+	if eventType == "" {
+		eventType = e.Type
+	}
+	events, err := h.FindWithin(rule.historyServer(e), eventType, *id, d)
+	if err != nil {
+		return err
+	}
+
+	var numbers []float64
+	distinct := map[string]bool{}
+	for _, event := range events {
+		if other := subjectId(event, rule.Subject); other == nil || *other != *id {
+			continue
+		}
+		v, ok := event.Values[rule.SourceField]
+		if !ok || v == nil {
+			continue
+		}
+		if n, numeric := normalizeNumber(v); numeric {
+			numbers = append(numbers, toFloat(n))
+			distinct[formatNumber(n)] = true
+		} else {
+			distinct[fmt.Sprintf("%v", v)] = true
+		}
+	}
+
+	var value interface{}
+	switch rule.Field {
+	case VirtualFieldDistinctCount:
+		value = len(distinct)
+	case VirtualFieldSum:
+		sum := 0.0
+		for _, n := range numbers {
+			sum += n
+		}
+		value = sum
+	case VirtualFieldAvg, VirtualFieldMax, VirtualFieldMin:
+		if len(numbers) == 0 {
+			return nil
+		}
+		value = aggregate(rule.Field, numbers)
 	}
+	e.Values[rule.Field] = value
+	e.Values[AggregateFieldName(rule.Field, rule.SourceField)] = value
 	return nil
 }
+
+func aggregate(field string, numbers []float64) float64 {
+	res := numbers[0]
+	for _, n := range numbers[1:] {
+		switch field {
+		case VirtualFieldAvg:
+			res += n
+		case VirtualFieldMax:
+			res = math.Max(res, n)
+		case VirtualFieldMin:
+			res = math.Min(res, n)
+		}
+	}
+	if field == VirtualFieldAvg {
+		res /= float64(len(numbers))
+	}
+	return res
+}
+
+func toFloat(n interface{}) float64 {
+	if i, ok := n.(int64); ok {
+		return float64(i)
+	}
+	return n.(float64)
+}
+
+func (r Rule) since(fallback time.Duration) (time.Duration, error) {
+	if r.Since == "" {
+		return fallback, nil
+	}
+	return time.ParseDuration(r.Since)
+}
+
+// killStreak returns the number of kills of the player since the last death of the player.
+func killStreak(h EventHistory, server *string, cftoolsId string, within time.Duration) (int, error) {
+	var lastDeath time.Time
+	for _, t := range []string{EventPlayerDeathEnvironment, EventPlayerDeathStarvation} {
+		deaths, err := h.FindWithin(server, t, cftoolsId, within)
+		if err != nil {
+			return 0, err
+		}
+		for _, death := range deaths {
+			if death.Timestamp.After(lastDeath) {
+				lastDeath = death.Timestamp
+			}
+		}
+	}
+	kills, err := h.FindWithin(server, EventPlayerKill, cftoolsId, within)
+	if err != nil {
+		return 0, err
+	}
+	for _, kill := range kills {
+		if kill.Values[FieldVictimCfToolsId] == cftoolsId && kill.Timestamp.After(lastDeath) {
+			lastDeath = kill.Timestamp
+		}
+	}
+	streak := 0
+	for _, kill := range kills {
+		if kill.Values[FieldMurdererCfToolsId] == cftoolsId && kill.Values[FieldVictimCfToolsId] != cftoolsId && kill.Timestamp.After(lastDeath) {
+			streak++
+		}
+	}
+	return streak, nil
+}
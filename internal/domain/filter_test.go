@@ -3,7 +3,9 @@ package domain_test
 import (
 	"cftools-relay/internal/domain"
 	"encoding/json"
+	"fmt"
 	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
 	. "github.com/onsi/gomega"
 	"time"
 )
@@ -207,6 +209,84 @@ var _ = Describe("Filter", func() {
 				Expect(filter).To(HaveLen(0))
 			})
 		})
+		Context("strict numeric comparators", func() {
+			DescribeTable("comparing numberKey (100.12)",
+				func(comparator string, value interface{}, expected bool) {
+					filters := domain.FilterList{{
+						Event: someEvent.Type,
+						Rules: domain.RuleList{{
+							Comparator: comparator,
+							Field:      "numberKey",
+							Value:      value,
+						}},
+					}}
+					matches, _, err := filters.MatchingFilters(history, someEvent)
+					Expect(err).ToNot(HaveOccurred())
+					Expect(matches).To(Equal(expected))
+				},
+				Entry("gt does not match equal value", "gt", 100.12, false),
+				Entry("gte matches equal value", "gte", 100.12, true),
+				Entry("gte does not match greater value", "gte", 100.13, false),
+				Entry("lt does not match equal value", "lt", 100.12, false),
+				Entry("lte matches equal value", "lte", 100.12, true),
+				Entry("lte does not match smaller value", "lte", 100.11, false),
+				Entry("between matches value in range", "between", []interface{}{100.0, 200.0}, true),
+				Entry("between matches inclusive bounds", "between", []float64{100.12, 100.12}, true),
+				Entry("between does not match value out of range", "between", []interface{}{0, 100}, false),
+				Entry("between does not match without two bounds", "between", 100, false),
+			)
+
+			DescribeTable("comparing non-numeric fields",
+				func(comparator string, value, fieldValue interface{}) {
+					rule := domain.Rule{Comparator: comparator, Field: "field", Value: value}
+					e := domain.Event{Type: someEvent.Type, Values: map[string]interface{}{"field": fieldValue}}
+
+					Expect(rule.Matches(history, e)).To(BeFalse())
+				},
+				Entry("lt does not match a text", "lt", 0, "someValue"),
+				Entry("lte does not match a text", "lte", 0, "someValue"),
+				Entry("lte does not match a boolean", "lte", 0, true),
+				Entry("gte does not match a text with a negative value", "gte", -1, "someValue"),
+				Entry("between does not match a text", "between", []interface{}{-5, 0}, "someValue"),
+				Entry("between does not match a boolean", "between", []interface{}{-5, 0}, false),
+			)
+
+			It("compares large numbers precisely", func() {
+				rule := domain.Rule{Comparator: "gte", Field: "field", Value: 16777217}
+				e := domain.Event{Type: someEvent.Type, Values: map[string]interface{}{"field": "16777216"}}
+
+				Expect(rule.Matches(history, e)).To(BeFalse())
+				e.Values["field"] = int64(16777217)
+				Expect(rule.Matches(history, e)).To(BeTrue())
+			})
+		})
+
+		Context("negation and presence comparators", func() {
+			DescribeTable("comparing someKey (someValue)",
+				func(comparator, field string, value interface{}, expected bool) {
+					filters := domain.FilterList{{
+						Event: someEvent.Type,
+						Rules: domain.RuleList{{
+							Comparator: comparator,
+							Field:      field,
+							Value:      value,
+						}},
+					}}
+					matches, _, err := filters.MatchingFilters(history, someEvent)
+					Expect(err).ToNot(HaveOccurred())
+					Expect(matches).To(Equal(expected))
+				},
+				Entry("neq matches different value", "neq", "someKey", "anotherValue", true),
+				Entry("neq does not match same value", "neq", "someKey", "someValue", false),
+				Entry("notOneOf matches value not in list", "notOneOf", "someKey", []string{"anotherValue"}, true),
+				Entry("notOneOf does not match value in list", "notOneOf", "someKey", []string{"someValue"}, false),
+				Entry("exists matches present field", "exists", "someKey", nil, true),
+				Entry("exists does not match missing field", "exists", "unknownKey", nil, false),
+				Entry("missing matches missing field", "missing", "unknownKey", nil, true),
+				Entry("missing does not match present field", "missing", "someKey", nil, false),
+			)
+		})
+
 		Context("contains comparator", func() {
 			It("MatchingFilters event", func() {
 				filters := domain.FilterList{{
@@ -348,9 +428,234 @@ var _ = Describe("Filter", func() {
 		})
 	})
 
+	Context("matches comparator", func() {
+		It("MatchingFilters event", func() {
+			filters := domain.FilterList{{
+				Event: someEvent.Type,
+				Rules: domain.RuleList{{
+					Comparator: "matches",
+					Field:      "someKey",
+					Value:      "^some(Value|Thing)$",
+				}},
+			}}
+			Expect(filters.Compile()).To(Succeed())
+			matches, filter, _ := filters.MatchingFilters(history, someEvent)
+			Expect(matches).To(BeTrue())
+			Expect(filter[0]).To(Equal(filters[0]))
+		})
+
+		It("does not match event", func() {
+			filters := domain.FilterList{{
+				Event: someEvent.Type,
+				Rules: domain.RuleList{{
+					Comparator: "matches",
+					Field:      "someKey",
+					Value:      "^Value",
+				}},
+			}}
+			Expect(filters.Compile()).To(Succeed())
+			matches, filter, _ := filters.MatchingFilters(history, someEvent)
+			Expect(matches).To(BeFalse())
+			Expect(filter).To(HaveLen(0))
+		})
+
+		It("reports invalid patterns when compiling", func() {
+			filters := domain.FilterList{{
+				Event: someEvent.Type,
+				Rules: domain.RuleList{{
+					Not: &domain.Rule{
+						Comparator: "matches",
+						Field:      "someKey",
+						Value:      "(unclosed",
+					},
+				}},
+			}}
+			Expect(filters.Compile()).To(MatchError(ContainSubstring("filter 0: invalid pattern for field someKey")))
+		})
+	})
+
+	Context("case-insensitive comparators", func() {
+		for comparator, value := range map[string]interface{}{
+			"eqIgnoreCase":         "SOMEVALUE",
+			"containsIgnoreCase":   "EVAL",
+			"startsWithIgnoreCase": "SOME",
+			"endsWithIgnoreCase":   "VALUE",
+			"oneOfIgnoreCase":      []string{"anotherValue", "SomeValue"},
+		} {
+			comparator, value := comparator, value
+			It(comparator+" matches regardless of case", func() {
+				filters := domain.FilterList{{
+					Event: someEvent.Type,
+					Rules: domain.RuleList{{
+						Comparator: comparator,
+						Field:      "someKey",
+						Value:      value,
+					}},
+				}}
+				matches, _, err := filters.MatchingFilters(history, someEvent)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(matches).To(BeTrue())
+			})
+		}
+
+		It("does not match different values", func() {
+			filters := domain.FilterList{{
+				Event: someEvent.Type,
+				Rules: domain.RuleList{{
+					Comparator: "eqIgnoreCase",
+					Field:      "someKey",
+					Value:      "SOME",
+				}},
+			}}
+			matches, _, err := filters.MatchingFilters(history, someEvent)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(matches).To(BeFalse())
+		})
+	})
+
+	Context("rule groups", func() {
+		weapon := func(w string) domain.Rule {
+			return domain.Rule{Comparator: "eq", Field: "someKey", Value: w}
+		}
+		distance := domain.Rule{Comparator: "gt", Field: "numberKey", Value: 100}
+
+		It("matches any group when one rule matches", func() {
+			filters := domain.FilterList{{
+				Event: someEvent.Type,
+				Rules: domain.RuleList{{
+					Any: domain.RuleList{weapon("anotherValue"), weapon("someValue")},
+				}},
+			}}
+			matches, _, err := filters.MatchingFilters(history, someEvent)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(matches).To(BeTrue())
+		})
+
+		It("does not match any group when no rule matches", func() {
+			filters := domain.FilterList{{
+				Event: someEvent.Type,
+				Rules: domain.RuleList{{
+					Any: domain.RuleList{weapon("anotherValue"), weapon("yetAnotherValue")},
+				}},
+			}}
+			matches, _, err := filters.MatchingFilters(history, someEvent)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(matches).To(BeFalse())
+		})
+
+		It("negates rules with not", func() {
+			filters := domain.FilterList{{
+				Event: someEvent.Type,
+				Rules: domain.RuleList{{
+					Not: &domain.Rule{Comparator: "eq", Field: "someKey", Value: "someValue"},
+				}},
+			}}
+			matches, _, err := filters.MatchingFilters(history, someEvent)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(matches).To(BeFalse())
+		})
+
+		It("nests groups arbitrarily", func() {
+			filters := domain.FilterList{{
+				Event: someEvent.Type,
+				Rules: domain.RuleList{{
+					All: domain.RuleList{
+						{Any: domain.RuleList{weapon("anotherValue"), weapon("someValue")}},
+						distance,
+						{Not: &domain.Rule{Any: domain.RuleList{
+							{Comparator: "eq", Field: domain.FieldCfToolsId, Value: "ADMIN_ID"},
+						}}},
+					},
+				}},
+			}}
+			matches, _, err := filters.MatchingFilters(history, someEvent)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(matches).To(BeTrue())
+		})
+
+		It("parses groups from JSON", func() {
+			var rules domain.RuleList
+			err := json.Unmarshal([]byte(`[
+				{"any": [{"comparator": "eq", "field": "someKey", "value": "someValue"}]},
+				{"not": {"comparator": "eq", "field": "someKey", "value": "anotherValue"}}
+			]`), &rules)
+			Expect(err).ToNot(HaveOccurred())
+
+			matches, err := rules.MatchesAll(history, someEvent)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(matches).To(BeTrue())
+		})
+	})
+
+	Context("targets", func() {
+		It("relays to the default target when no targets are configured", func() {
+			f := domain.Filter{Event: someEvent.Type}
+
+			Expect(domain.Server{}.TargetNames(&f)).To(Equal([]string{domain.DefaultTarget}))
+			Expect(domain.Server{}.TargetNames(nil)).To(Equal([]string{domain.DefaultTarget}))
+		})
+
+		It("relays to the configured targets", func() {
+			f := domain.Filter{Event: someEvent.Type, Targets: []string{"killfeed", "admin"}}
+
+			Expect(domain.Server{Targets: []string{"pvp"}}.TargetNames(&f)).To(Equal([]string{"killfeed", "admin"}))
+		})
+
+		It("relays to the targets of the server when the filter has none", func() {
+			f := domain.Filter{Event: someEvent.Type}
+			s := domain.Server{Targets: []string{"pvp"}}
+
+			Expect(s.TargetNames(&f)).To(Equal([]string{"pvp"}))
+			Expect(s.TargetNames(nil)).To(Equal([]string{"pvp"}))
+		})
+	})
+
+	Context("server filters", func() {
+		global := domain.FilterList{{Event: domain.EventUserJoin}}
+		own := domain.FilterList{{Event: domain.EventPlayerKill}}
+
+		It("applies the global filters", func() {
+			Expect(domain.Server{}.Filters(global)).To(Equal(global))
+		})
+
+		It("applies the own filters in addition to the global filters", func() {
+			Expect(domain.Server{Filter: own}.Filters(global)).To(Equal(domain.FilterList{global[0], own[0]}))
+		})
+
+		It("applies the own filters only, when opted out of the global filters", func() {
+			Expect(domain.Server{Filter: own, IgnoreGlobalFilter: true}.Filters(global)).To(Equal(own))
+		})
+	})
+
+	Context("label", func() {
+		It("uses the name or the position of the filter", func() {
+			filters := domain.FilterList{{Event: someEvent.Type}, {Name: "long-range-kills", Event: someEvent.Type}}
+			Expect(filters.Compile()).To(Succeed())
+
+			Expect(filters[0].Label()).To(Equal("filter[0]"))
+			Expect(filters[1].Label()).To(Equal("long-range-kills"))
+		})
+	})
+
+	Context("session fields", func() {
+		It("lists the session virtual fields, which the rules or the format of the filter use", func() {
+			f := domain.Filter{
+				Rules: domain.RuleList{{Not: &domain.Rule{Comparator: "eq", Field: domain.VirtualFieldIsFirstJoin, Value: true}}},
+				Format: &domain.Format{Type: domain.FormatTypeText, Parameters: map[string]interface{}{
+					"template": "{{.vf_online_count}} players are online.",
+				}},
+			}
+
+			Expect(f.SessionFields()).To(Equal(map[string]bool{
+				domain.VirtualFieldIsFirstJoin: true,
+				domain.VirtualFieldOnlineCount: true,
+			}))
+		})
+	})
+
 	Context("virtual fields", func() {
 		Context("event_count", func() {
-			It("MatchingFilters when event_count is greater than", func() {
+			It("MatchingFilters when event_count is greater than or equal", func() {
 				err := history.Save(domain.Event{
 					Type:      someEvent.Type,
 					Timestamp: time.Now().Add(-40 * time.Minute),
@@ -362,7 +667,7 @@ var _ = Describe("Filter", func() {
 				filters := domain.FilterList{{
 					Event: someEvent.Type,
 					Rules: domain.RuleList{{
-						Comparator: "gt",
+						Comparator: "gte",
 						Field:      domain.VirtualFieldEventCount,
 						Value:      1,
 						Since:      "1h",
@@ -373,6 +678,25 @@ var _ = Describe("Filter", func() {
 				Expect(matches).To(BeTrue())
 				Expect(filter[0]).To(Equal(filters[0]))
 			})
+			It("counts the events of the same server only, when scoped to the server", func() {
+				for _, server := range []string{"pvp", "pve", "pve"} {
+					Expect(history.Save(domain.Event{
+						Type:      someEvent.Type,
+						Server:    server,
+						Timestamp: time.Now(),
+						Values:    map[string]interface{}{domain.FieldCfToolsId: *someEvent.CFToolsId()},
+					})).To(Succeed())
+				}
+				rule := domain.Rule{Comparator: "gte", Field: domain.VirtualFieldEventCount, Value: 2}
+				e := someEvent
+				e.Server = "pvp"
+
+				Expect(rule.Matches(history, e)).To(BeTrue())
+				rule.Scope = domain.ScopeServer
+				Expect(rule.Matches(history, e)).To(BeFalse())
+				e.Server = "pve"
+				Expect(rule.Matches(history, e)).To(BeTrue())
+			})
 			It("does not match when less than events", func() {
 				filters := domain.FilterList{{
 					Event: someEvent.Type,
@@ -387,10 +711,197 @@ var _ = Describe("Filter", func() {
 				Expect(matches).To(BeFalse())
 				Expect(filter).To(HaveLen(0))
 			})
+			It("does not count the events, which the player is not the main player of", func() {
+				Expect(history.Save(kill("A_MURDERER", "AN_ID", time.Now()))).To(Succeed())
+				rule := domain.Rule{Comparator: "eq", Field: domain.VirtualFieldEventCount, Value: 1}
+
+				Expect(rule.Matches(history, kill("AN_ID", "A_VICTIM", time.Now()))).To(BeFalse())
+			})
+		})
+
+		Context("subject", func() {
+			It("counts the events of the victim", func() {
+				for _, murderer := range []string{"A_MURDERER", "ANOTHER_MURDERER", "AN_ID"} {
+					Expect(history.Save(kill(murderer, "A_VICTIM", time.Now()))).To(Succeed())
+				}
+				rule := domain.Rule{Comparator: "eq", Field: domain.VirtualFieldEventCount, Value: 3, Since: "10m", Subject: domain.SubjectVictim}
+
+				Expect(rule.Matches(history, kill("AN_ID", "A_VICTIM", time.Now()))).To(BeTrue())
+				rule.Subject = domain.SubjectMurderer
+				Expect(rule.Matches(history, kill("AN_ID", "A_VICTIM", time.Now()))).To(BeFalse())
+			})
+
+			It("does not match events without the subject", func() {
+				rule := domain.Rule{Comparator: "gte", Field: domain.VirtualFieldEventCount, Value: 0, Subject: domain.SubjectVictim}
+
+				Expect(rule.Matches(history, someEvent)).To(BeFalse())
+			})
+		})
+
+		Context("pair_event_count", func() {
+			It("counts the kills of the same murderer and victim", func() {
+				Expect(history.Save(kill("AN_ID", "A_VICTIM", time.Now()))).To(Succeed())
+				Expect(history.Save(kill("AN_ID", "A_VICTIM", time.Now()))).To(Succeed())
+				Expect(history.Save(kill("AN_ID", "ANOTHER_VICTIM", time.Now()))).To(Succeed())
+				Expect(history.Save(kill("A_VICTIM", "AN_ID", time.Now()))).To(Succeed())
+				rule := domain.Rule{Comparator: "eq", Field: domain.VirtualFieldPairEventCount, Value: 2}
+
+				Expect(rule.Matches(history, kill("AN_ID", "A_VICTIM", time.Now()))).To(BeTrue())
+			})
+		})
+
+		Context("aggregates", func() {
+			BeforeEach(func() {
+				for i, distance := range []interface{}{100, 250.5, "unknown", 400} {
+					e := kill("AN_ID", fmt.Sprintf("VICTIM_%d", i%2), time.Now())
+					e.Values["distance"] = distance
+					Expect(history.Save(e)).To(Succeed())
+				}
+				old := kill("AN_ID", "A_VICTIM", time.Now().Add(-2*time.Hour))
+				old.Values["distance"] = 1000
+				Expect(history.Save(old)).To(Succeed())
+				Expect(history.Save(domain.Event{
+					Type:      domain.EventPlayerDamage,
+					Timestamp: time.Now(),
+					Values:    map[string]interface{}{domain.FieldMurdererCfToolsId: "AN_ID", "damage": 35},
+				})).To(Succeed())
+			})
+
+			aggregate := func(field, source, sourceEvent string) interface{} {
+				e := kill("AN_ID", "A_VICTIM", time.Now())
+				rule := domain.Rule{Comparator: "exists", Field: field, SourceField: source, SourceEvent: sourceEvent, Since: "1h"}
+				_, err := rule.Matches(history, e)
+				Expect(err).ToNot(HaveOccurred())
+				v, ok := e.Values[field]
+				named, namedOk := e.Values[domain.AggregateFieldName(field, source)]
+				Expect(namedOk).To(Equal(ok))
+				if ok {
+					Expect(named).To(Equal(v))
+				}
+				return v
+			}
+
+			It("aggregates the numeric values of the source field", func() {
+				Expect(aggregate(domain.VirtualFieldSum, "distance", "")).To(Equal(750.5))
+				Expect(aggregate(domain.VirtualFieldAvg, "distance", "")).To(BeNumerically("~", 250.1666, 0.001))
+				Expect(aggregate(domain.VirtualFieldMax, "distance", "")).To(Equal(400.0))
+				Expect(aggregate(domain.VirtualFieldMin, "distance", "")).To(Equal(100.0))
+			})
+
+			It("counts the distinct values of the source field", func() {
+				Expect(aggregate(domain.VirtualFieldDistinctCount, "distance", "")).To(Equal(4))
+				Expect(aggregate(domain.VirtualFieldDistinctCount, domain.FieldVictimCfToolsId, "")).To(Equal(2))
+			})
+
+			It("aggregates the events of the source event type", func() {
+				Expect(aggregate(domain.VirtualFieldSum, "damage", domain.EventPlayerDamage)).To(Equal(35.0))
+			})
+
+			It("does not set the average without any value", func() {
+				Expect(aggregate(domain.VirtualFieldAvg, "weapon", "")).To(BeNil())
+				Expect(aggregate(domain.VirtualFieldSum, "weapon", "")).To(Equal(0.0))
+			})
+
+			It("compares the aggregated value", func() {
+				rule := domain.Rule{Comparator: "gt", Field: domain.VirtualFieldAvg, SourceField: "distance", Value: 200}
+
+				Expect(rule.Matches(history, kill("AN_ID", "A_VICTIM", time.Now()))).To(BeTrue())
+			})
+
+			It("sets the virtual fields of each filter in the event of the filter only", func() {
+				filters := domain.FilterList{{
+					Event: domain.EventPlayerKill,
+					Rules: domain.RuleList{{Comparator: "gt", Field: domain.VirtualFieldSum, SourceField: "distance", Value: 0, Since: "1h"}},
+				}, {
+					Event: domain.EventPlayerKill,
+					Rules: domain.RuleList{{Comparator: "gt", Field: domain.VirtualFieldSum, SourceField: "distance", Value: 0, Since: "3h"}},
+				}}
+				e := kill("AN_ID", "A_VICTIM", time.Now())
+
+				_, matches, err := filters.Matching(history, e)
+				Expect(err).ToNot(HaveOccurred())
+
+				Expect(matches).To(HaveLen(2))
+				Expect(matches[0].Event.Values).To(HaveKeyWithValue(domain.VirtualFieldSum, 750.5))
+				Expect(matches[1].Event.Values).To(HaveKeyWithValue(domain.VirtualFieldSum, 1750.5))
+				Expect(e.Values).ToNot(HaveKey(domain.VirtualFieldSum))
+			})
+
+			It("sets the virtual fields of the rules, which were not needed for the match", func() {
+				filters := domain.FilterList{{
+					Event: domain.EventPlayerKill,
+					Rules: domain.RuleList{{Any: domain.RuleList{
+						{Comparator: "gt", Field: domain.VirtualFieldAvg, SourceField: "distance", Value: 200},
+						{Comparator: "gt", Field: domain.VirtualFieldSum, SourceField: "damage", SourceEvent: domain.EventPlayerDamage, Value: 100},
+					}}},
+				}}
+
+				_, matches, err := filters.Matching(history, kill("AN_ID", "A_VICTIM", time.Now()))
+				Expect(err).ToNot(HaveOccurred())
+
+				Expect(matches).To(HaveLen(1))
+				Expect(matches[0].Event.Values).To(HaveKey(domain.AggregateFieldName(domain.VirtualFieldAvg, "distance")))
+				Expect(matches[0].Event.Values).To(HaveKeyWithValue(domain.AggregateFieldName(domain.VirtualFieldSum, "damage"), 35.0))
+			})
+		})
+
+		Context("kill_streak", func() {
+			streak := func(e domain.Event) interface{} {
+				rule := domain.Rule{Comparator: "gte", Field: domain.VirtualFieldKillStreak, Value: 0}
+				Expect(rule.Matches(history, e)).To(BeTrue())
+				return e.Values[domain.VirtualFieldKillStreak]
+			}
+
+			It("counts the kills of the murderer", func() {
+				for i := 0; i < 3; i++ {
+					Expect(history.Save(kill("AN_ID", "A_VICTIM", time.Now().Add(-time.Duration(i)*time.Hour)))).To(Succeed())
+				}
+
+				Expect(streak(kill("AN_ID", "A_VICTIM", time.Now()))).To(Equal(3))
+			})
+
+			It("resets when the murderer was killed", func() {
+				Expect(history.Save(kill("AN_ID", "A_VICTIM", time.Now().Add(-3*time.Minute)))).To(Succeed())
+				Expect(history.Save(kill("ANOTHER_ID", "AN_ID", time.Now().Add(-2*time.Minute)))).To(Succeed())
+				Expect(history.Save(kill("AN_ID", "A_VICTIM", time.Now().Add(-1*time.Minute)))).To(Succeed())
+
+				Expect(streak(kill("AN_ID", "A_VICTIM", time.Now()))).To(Equal(1))
+				Expect(streak(kill("ANOTHER_ID", "A_VICTIM", time.Now()))).To(Equal(1))
+			})
+
+			It("resets when the murderer died otherwise", func() {
+				Expect(history.Save(kill("AN_ID", "A_VICTIM", time.Now().Add(-3*time.Minute)))).To(Succeed())
+				Expect(history.Save(domain.Event{
+					Type:      domain.EventPlayerDeathStarvation,
+					Timestamp: time.Now().Add(-2 * time.Minute),
+					Values:    map[string]interface{}{domain.FieldCfToolsId: "AN_ID"},
+				})).To(Succeed())
+
+				Expect(streak(kill("AN_ID", "A_VICTIM", time.Now()))).To(Equal(0))
+			})
+
+			It("counts the kills within since only", func() {
+				Expect(history.Save(kill("AN_ID", "A_VICTIM", time.Now().Add(-2*time.Hour)))).To(Succeed())
+				Expect(history.Save(kill("AN_ID", "A_VICTIM", time.Now().Add(-1*time.Minute)))).To(Succeed())
+				rule := domain.Rule{Comparator: "eq", Field: domain.VirtualFieldKillStreak, Value: 1, Since: "1h"}
+
+				Expect(rule.Matches(history, kill("AN_ID", "A_VICTIM", time.Now()))).To(BeTrue())
+			})
 		})
 	})
 })
 
+func kill(murderer, victim string, t time.Time) domain.Event {
+	return domain.Event{
+		Type:      domain.EventPlayerKill,
+		Timestamp: t,
+		Values: map[string]interface{}{
+			domain.FieldMurdererCfToolsId: murderer,
+			domain.FieldVictimCfToolsId:   victim,
+		},
+	}
+}
+
 type inMemoryRepository struct {
 	data map[string][]domain.Event
 }
@@ -402,11 +913,13 @@ func NewInMemoryEventHistoryRepository() *inMemoryRepository {
 }
 
 func (r inMemoryRepository) Save(e domain.Event) error {
-	r.data[*e.CFToolsId()] = append(r.data[*e.CFToolsId()], e)
+	for _, id := range e.CFToolsIds() {
+		r.data[id] = append(r.data[id], e)
+	}
 	return nil
 }
 
-func (r inMemoryRepository) FindWithin(eventType, cftoolsId string, within time.Duration) ([]domain.Event, error) {
+func (r inMemoryRepository) FindWithin(server *string, eventType, cftoolsId string, within time.Duration) ([]domain.Event, error) {
 	d, ok := r.data[cftoolsId]
 	if !ok {
 		return []domain.Event{}, nil
@@ -414,7 +927,7 @@ func (r inMemoryRepository) FindWithin(eventType, cftoolsId string, within time.
 	res := []domain.Event{}
 	latest := time.Now().Add(-within)
 	for _, event := range d {
-		if event.Type != eventType {
+		if event.Type != eventType || (server != nil && event.Server != *server) {
 			continue
 		}
 		if event.Timestamp.Before(latest) {
@@ -1,5 +1,31 @@
 package domain
 
+import "time"
+
+const (
+	TargetTypeDiscord = "discord"
+
+	DefaultTarget = "default"
+)
+
 type Target interface {
 	Relay(e Event, f *Filter, serverName *string) error
 }
+
+type TargetConfig struct {
+	Type       string `json:"type"`
+	WebhookUrl string `json:"webhook_url,omitempty"`
+}
+
+// DeliveryStatus describes the most recent delivery attempts to a target.
+type DeliveryStatus struct {
+	Pending     int        `json:"pending"`
+	LastSuccess *time.Time `json:"last_success,omitempty"`
+	LastFailure *time.Time `json:"last_failure,omitempty"`
+	LastError   string     `json:"last_error,omitempty"`
+}
+
+// Healthy reports whether the most recent delivery attempt to the target succeeded, or no delivery was attempted yet.
+func (s DeliveryStatus) Healthy() bool {
+	return s.LastFailure == nil || (s.LastSuccess != nil && s.LastSuccess.After(*s.LastFailure))
+}
@@ -0,0 +1,128 @@
+package domain
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Schedule limits a filter to certain weekdays and times of the day. Without weekdays, every day is part of the
+// schedule, without times, the whole day.
+type Schedule struct {
+	// TimeZone is the name of the time zone, e.g. Europe/Berlin, of the weekdays and times. It is the time zone of the
+	// system, if it is empty.
+	TimeZone string      `json:"time_zone,omitempty"`
+	Weekdays []string    `json:"weekdays,omitempty"`
+	Times    []TimeRange `json:"times,omitempty"`
+
+	location *time.Location
+	weekdays map[time.Weekday]bool
+	ranges   [][2]int
+}
+
+// TimeRange is the time between From and To, both in the format 15:04. A range ends on the next day, if To is not after
+// From, e.g. 22:00 to 02:00.
+type TimeRange struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+var weekdayNames = map[string]time.Weekday{
+	"sunday":    time.Sunday,
+	"monday":    time.Monday,
+	"tuesday":   time.Tuesday,
+	"wednesday": time.Wednesday,
+	"thursday":  time.Thursday,
+	"friday":    time.Friday,
+	"saturday":  time.Saturday,
+}
+
+func IsWeekday(d string) bool {
+	_, ok := weekdayNames[strings.ToLower(d)]
+	return ok
+}
+
+// ParseClock returns the minutes since midnight of a time of the day in the format 15:04.
+func ParseClock(s string) (int, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("expected a time like 15:04, got %q", s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+func (s *Schedule) compile() error {
+	if s == nil {
+		return nil
+	}
+	s.location = time.Local
+	if s.TimeZone != "" {
+		l, err := time.LoadLocation(s.TimeZone)
+		if err != nil {
+			return err
+		}
+		s.location = l
+	}
+	s.weekdays = map[time.Weekday]bool{}
+	for _, d := range s.Weekdays {
+		w, ok := weekdayNames[strings.ToLower(d)]
+		if !ok {
+			return fmt.Errorf("unknown weekday %q", d)
+		}
+		s.weekdays[w] = true
+	}
+	s.ranges = nil
+	for _, r := range s.Times {
+		from, err := ParseClock(r.From)
+		if err != nil {
+			return err
+		}
+		to, err := ParseClock(r.To)
+		if err != nil {
+			return err
+		}
+		s.ranges = append(s.ranges, [2]int{from, to})
+	}
+	return nil
+}
+
+// Active reports whether t is within the schedule. A time range, which ends on the next day, belongs to the weekday it
+// starts on, e.g. friday from 22:00 to 02:00 includes saturday 01:00. A nil schedule is always active.
+func (s *Schedule) Active(t time.Time) bool {
+	if s == nil {
+		return true
+	}
+	if s.location == nil {
+		compiled := *s
+		if err := compiled.compile(); err != nil {
+			return false
+		}
+		s = &compiled
+	}
+	t = t.In(s.location)
+	day := t.Weekday()
+	if len(s.ranges) == 0 {
+		return s.on(day)
+	}
+	minute := t.Hour()*60 + t.Minute()
+	for _, r := range s.ranges {
+		from, to := r[0], r[1]
+		if from < to {
+			if minute >= from && minute < to && s.on(day) {
+				return true
+			}
+			continue
+		}
+		if minute >= from && s.on(day) {
+			return true
+		}
+		if minute < to && s.on((day+6)%7) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Schedule) on(d time.Weekday) bool {
+	return len(s.weekdays) == 0 || s.weekdays[d]
+}
@@ -0,0 +1,57 @@
+package domain_test
+
+import (
+	"cftools-relay/internal/domain"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+	"time"
+)
+
+var _ = Describe("Schedule", func() {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		panic(err)
+	}
+	// at returns the time of the day on the given date in May 2024, the 3rd is a friday.
+	at := func(day, hour, minute int) time.Time {
+		return time.Date(2024, time.May, day, hour, minute, 0, 0, berlin)
+	}
+
+	DescribeTable("active",
+		func(s *domain.Schedule, t time.Time, expected bool) {
+			Expect(s.Active(t)).To(Equal(expected))
+		},
+		Entry("without a schedule", nil, at(3, 12, 0), true),
+		Entry("on a weekday of the schedule", &domain.Schedule{TimeZone: "Europe/Berlin", Weekdays: []string{"friday"}}, at(3, 12, 0), true),
+		Entry("on another weekday", &domain.Schedule{TimeZone: "Europe/Berlin", Weekdays: []string{"Friday"}}, at(4, 12, 0), false),
+		Entry("at the start of a time range", &domain.Schedule{TimeZone: "Europe/Berlin", Times: []domain.TimeRange{{From: "02:00", To: "06:00"}}}, at(3, 2, 0), true),
+		Entry("at the end of a time range", &domain.Schedule{TimeZone: "Europe/Berlin", Times: []domain.TimeRange{{From: "02:00", To: "06:00"}}}, at(3, 6, 0), false),
+		Entry("before midnight of a range spanning midnight", &domain.Schedule{TimeZone: "Europe/Berlin", Weekdays: []string{"friday"}, Times: []domain.TimeRange{{From: "22:00", To: "02:00"}}}, at(3, 23, 0), true),
+		Entry("after midnight of a range spanning midnight", &domain.Schedule{TimeZone: "Europe/Berlin", Weekdays: []string{"friday"}, Times: []domain.TimeRange{{From: "22:00", To: "02:00"}}}, at(4, 1, 59), true),
+		Entry("after midnight of a range starting on another weekday", &domain.Schedule{TimeZone: "Europe/Berlin", Weekdays: []string{"friday"}, Times: []domain.TimeRange{{From: "22:00", To: "02:00"}}}, at(3, 1, 0), false),
+		Entry("in another time zone", &domain.Schedule{TimeZone: "America/New_York", Times: []domain.TimeRange{{From: "02:00", To: "06:00"}}}, at(3, 9, 0), true),
+		Entry("in any of the time ranges", &domain.Schedule{TimeZone: "Europe/Berlin", Times: []domain.TimeRange{{From: "02:00", To: "06:00"}, {From: "18:00", To: "20:00"}}}, at(3, 19, 0), true),
+		Entry("with an invalid time zone", &domain.Schedule{TimeZone: "Mars/Olympus_Mons"}, at(3, 12, 0), false),
+	)
+
+	It("limits a filter to the schedule", func() {
+		l := domain.FilterList{{
+			Event:    domain.EventPlayerPlace,
+			Schedule: &domain.Schedule{TimeZone: "Europe/Berlin", Times: []domain.TimeRange{{From: "02:00", To: "06:00"}}},
+		}}
+		Expect(l.Compile()).To(Succeed())
+		e := func(t time.Time) domain.Event {
+			return domain.Event{Type: domain.EventPlayerPlace, Timestamp: t, Values: map[string]interface{}{}}
+		}
+
+		Expect(l[0].Matches(nil, e(at(3, 3, 0)))).To(BeTrue())
+		Expect(l[0].Matches(nil, e(at(3, 7, 0)))).To(BeFalse())
+	})
+
+	It("refuses to compile an invalid schedule", func() {
+		l := domain.FilterList{{Event: domain.EventPlayerPlace, Schedule: &domain.Schedule{Weekdays: []string{"someday"}}}}
+
+		Expect(l.Compile()).ToNot(Succeed())
+	})
+})
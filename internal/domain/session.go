@@ -0,0 +1,77 @@
+package domain
+
+import "strings"
+
+const (
+	VirtualFieldSessionDuration = "vf_session_duration"
+	VirtualFieldIsFirstJoin     = "vf_is_first_join"
+	VirtualFieldSessionsToday   = "vf_sessions_today"
+	VirtualFieldOnlineCount     = "vf_online_count"
+)
+
+// SessionTracker pairs the user.join and user.leave events of a player per server to sessions.
+type SessionTracker interface {
+	// Track updates the session of the player of the event and sets the session virtual fields in the event. The event
+	// is expected to be saved in the history already.
+	Track(e Event) error
+}
+
+// IsSessionField reports whether f is a virtual field, which is set by the SessionTracker instead of being evaluated for
+// each rule.
+func IsSessionField(f string) bool {
+	switch f {
+	case VirtualFieldSessionDuration, VirtualFieldIsFirstJoin, VirtualFieldSessionsToday, VirtualFieldOnlineCount:
+		return true
+	}
+	return false
+}
+
+// SessionFields returns the session virtual fields, which the rules or the format of the filter reference. A nil filter
+// references none.
+func (f *Filter) SessionFields() map[string]bool {
+	fields := map[string]bool{}
+	if f == nil {
+		return fields
+	}
+	f.Rules.sessionFields(fields)
+	if f.Format != nil {
+		for _, p := range f.Format.Parameters {
+			s, ok := p.(string)
+			if !ok {
+				continue
+			}
+			for _, field := range []string{VirtualFieldSessionDuration, VirtualFieldIsFirstJoin, VirtualFieldSessionsToday, VirtualFieldOnlineCount} {
+				if strings.Contains(s, field) {
+					fields[field] = true
+				}
+			}
+		}
+	}
+	return fields
+}
+
+func (l RuleList) sessionFields(fields map[string]bool) {
+	for _, r := range l {
+		if IsSessionField(r.Field) {
+			fields[r.Field] = true
+		}
+		r.All.sessionFields(fields)
+		r.Any.sessionFields(fields)
+		if r.Not != nil {
+			RuleList{*r.Not}.sessionFields(fields)
+		}
+	}
+}
+
+// WithoutSessionFields returns a copy of the event without the session virtual fields, which are not in keep, so that
+// messages show the session virtual fields only, if the filter uses them.
+func (e Event) WithoutSessionFields(keep map[string]bool) Event {
+	values := make(map[string]interface{}, len(e.Values))
+	for k, v := range e.Values {
+		if !IsSessionField(k) || keep[k] {
+			values[k] = v
+		}
+	}
+	e.Values = values
+	return e
+}
@@ -33,6 +33,23 @@ const (
 	FieldMurdererCfToolsId = "murderer_id"
 )
 
+var eventTypes = map[string]bool{
+	EventVerification:           true,
+	EventUserJoin:               true,
+	EventUserLeave:              true,
+	EventPlayerPlace:            true,
+	EventPlayerDeathStarvation:  true,
+	EventPlayerDeathEnvironment: true,
+	EventPlayerKill:             true,
+	EventPlayerDamage:           true,
+	EventUserChat:               true,
+}
+
+// IsEventType reports whether t is a type of event, which CFTools sends.
+func IsEventType(t string) bool {
+	return eventTypes[t]
+}
+
 var possibleMetadata = map[string]string{
 	"player_name":          "Name",
 	"player_steam64":       "Steam ID",
@@ -54,6 +71,34 @@ var possibleMetadata = map[string]string{
 type Server struct {
 	Secret string  `json:"secret"`
 	Name   *string `json:"name,omitempty"`
+	// Filter is applied to events of this server in addition to the global filters, unless IgnoreGlobalFilter is set.
+	Filter             FilterList `json:"filter,omitempty"`
+	IgnoreGlobalFilter bool       `json:"ignore_global_filter,omitempty"`
+	// Targets are used for events of this server, which match a filter without targets.
+	Targets []string `json:"targets,omitempty"`
+}
+
+// Filters returns the filters, which apply to events of this server.
+func (s Server) Filters(global FilterList) FilterList {
+	if s.IgnoreGlobalFilter {
+		return s.Filter
+	}
+	if len(s.Filter) == 0 {
+		return global
+	}
+	return append(append(FilterList{}, global...), s.Filter...)
+}
+
+// TargetNames returns the names of the targets, which an event of this server, matched by f, is relayed to. f is nil,
+// when the event is relayed without any filter.
+func (s Server) TargetNames(f *Filter) []string {
+	if f != nil && len(f.Targets) != 0 {
+		return f.Targets
+	}
+	if len(s.Targets) != 0 {
+		return s.Targets
+	}
+	return []string{DefaultTarget}
 }
 
 type EventFlavor = string
@@ -68,7 +113,9 @@ type WebhookEvent struct {
 }
 
 type Event struct {
-	Type      string
+	Type string
+	// Server is the id of the server, which the event was received from, as configured in the servers of the config.
+	Server    string `json:",omitempty"`
 	Timestamp time.Time
 	Values    map[string]interface{}
 }
@@ -79,7 +126,11 @@ type Data struct {
 	K, V string
 }
 
-func WebhookFromRequest(r *http.Request) (WebhookEvent, error) {
+// Clock returns the current time. Received events are timestamped with it, so that time dependent rules, like the
+// schedules of filters, can be tested with a fixed time.
+type Clock func() time.Time
+
+func WebhookFromRequest(r *http.Request, clock Clock) (WebhookEvent, error) {
 	p, err := ioutil.ReadAll(r.Body)
 	if err != nil {
 		return WebhookEvent{}, err
@@ -95,17 +146,19 @@ func WebhookFromRequest(r *http.Request) (WebhookEvent, error) {
 	if err != nil {
 		return WebhookEvent{}, err
 	}
+	e := Event{
+		Type:      r.Header.Get("X-Hephaistos-Event"),
+		Timestamp: clock(),
+		Values:    parsed,
+	}
+	e.ParsePositions()
 	return WebhookEvent{
 		ShardId:   shardId,
 		Flavor:    r.Header.Get("X-Hephaistos-Flavor"),
 		Id:        r.Header.Get("X-Hephaistos-Delivery"),
 		Signature: r.Header.Get("X-Hephaistos-Signature"),
 		Payload:   string(p),
-		Event: Event{
-			Type:      r.Header.Get("X-Hephaistos-Event"),
-			Timestamp: time.Now(),
-			Values:    parsed,
-		},
+		Event:     e,
 	}, nil
 }
 
@@ -158,8 +211,11 @@ func (e Event) Metadata() Metadata {
 	return m
 }
 
+var cfToolsIdFields = []string{FieldCfToolsId, FieldMurdererCfToolsId, FieldPlayerId, FieldVictimCfToolsId}
+
+// CFToolsId returns the CFTools ID of the player, who the event is mainly about, e.g. the murderer of a kill.
 func (e Event) CFToolsId() *string {
-	for _, f := range []string{FieldCfToolsId, FieldMurdererCfToolsId, FieldPlayerId, FieldVictimCfToolsId} {
+	for _, f := range cfToolsIdFields {
 		possibleId, ok := e.Values[f]
 		if id, isString := possibleId.(string); ok && isString {
 			return &id
@@ -167,3 +223,26 @@ func (e Event) CFToolsId() *string {
 	}
 	return nil
 }
+
+// withCopiedValues returns a copy of the event, whose values can be changed without changing the values of e.
+func (e Event) withCopiedValues() Event {
+	values := make(map[string]interface{}, len(e.Values))
+	for k, v := range e.Values {
+		values[k] = v
+	}
+	e.Values = values
+	return e
+}
+
+// CFToolsIds returns the CFTools IDs of all players involved in the event, starting with the one of CFToolsId.
+func (e Event) CFToolsIds() []string {
+	var ids []string
+	seen := map[string]bool{}
+	for _, f := range cfToolsIdFields {
+		if id, ok := e.Values[f].(string); ok && !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
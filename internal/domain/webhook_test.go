@@ -83,4 +83,32 @@ var _ = Describe("Event", func() {
 			Expect(e.CFToolsId()).To(BeNil())
 		})
 	})
+
+	Context("CFToolsIds", func() {
+		It("returns all involved players, starting with the main one", func() {
+			e := Event{
+				Type:      EventPlayerKill,
+				Timestamp: time.Now(),
+				Values: map[string]interface{}{
+					FieldVictimCfToolsId:   "ANOTHER_ID",
+					FieldMurdererCfToolsId: "AN_ID",
+				},
+			}
+
+			Expect(e.CFToolsIds()).To(Equal([]string{"AN_ID", "ANOTHER_ID"}))
+		})
+
+		It("returns each player once", func() {
+			e := Event{
+				Type:      EventPlayerKill,
+				Timestamp: time.Now(),
+				Values: map[string]interface{}{
+					FieldVictimCfToolsId:   "AN_ID",
+					FieldMurdererCfToolsId: "AN_ID",
+				},
+			}
+
+			Expect(e.CFToolsIds()).To(Equal([]string{"AN_ID"}))
+		})
+	})
 })
@@ -0,0 +1,173 @@
+package domain
+
+import (
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// positionPattern matches positions like <X: 4055.42, Y: 8895.48, Z: 324.61>, the labels and brackets are optional.
+// CFTools sends the brackets as u003c and u003e, which are JSON escapes without their backslash.
+var positionPattern = regexp.MustCompile(`^\s*(?:<|u003c)?\s*(?:X:\s*)?(-?[\d.]+)\s*,\s*(?:Y:\s*)?(-?[\d.]+)\s*,\s*(?:Z:\s*)?(-?[\d.]+)\s*(?:>|u003e)?\s*$`)
+
+// Position is a position on the map. X and Y are the coordinates on the map, Z is the altitude.
+type Position struct {
+	X, Y, Z float64
+}
+
+func ParsePosition(s string) (Position, bool) {
+	m := positionPattern.FindStringSubmatch(s)
+	if m == nil {
+		return Position{}, false
+	}
+	var coordinates [3]float64
+	for i := range coordinates {
+		c, err := strconv.ParseFloat(m[i+1], 64)
+		if err != nil {
+			return Position{}, false
+		}
+		coordinates[i] = c
+	}
+	return Position{X: coordinates[0], Y: coordinates[1], Z: coordinates[2]}, true
+}
+
+// ParsePositions sets the coordinates of each position field of the event (e.g. victim_position) as numeric fields
+// with the suffixes _x, _y and _z (e.g. victim_position_x). Existing fields are not replaced.
+func (e Event) ParsePositions() {
+	for k, v := range e.Values {
+		s, ok := v.(string)
+		if !ok || !strings.HasSuffix(k, "_position") {
+			continue
+		}
+		p, ok := ParsePosition(s)
+		if !ok {
+			continue
+		}
+		for suffix, c := range map[string]float64{"_x": p.X, "_y": p.Y, "_z": p.Z} {
+			if _, exists := e.Values[k+suffix]; !exists {
+				e.Values[k+suffix] = c
+			}
+		}
+	}
+}
+
+// position returns the position of the position field of the event, e.g. victim_position, from its parsed coordinates.
+func (e Event) position(field string) (Position, bool) {
+	x, okX := e.number(field + "_x")
+	y, okY := e.number(field + "_y")
+	if !okX || !okY {
+		return Position{}, false
+	}
+	z, _ := e.number(field + "_z")
+	return Position{X: x, Y: y, Z: z}, true
+}
+
+func (e Event) number(field string) (float64, bool) {
+	n, ok := normalizeNumber(e.Values[field])
+	if !ok {
+		return 0, false
+	}
+	return toFloat(n), true
+}
+
+// Zone is an area of the map, which is either a circle with a center and radius, or a polygon with at least three
+// corners. Coordinates are pairs of X and Y.
+type Zone struct {
+	Center  []float64   `json:"center,omitempty"`
+	Radius  float64     `json:"radius,omitempty"`
+	Polygon [][]float64 `json:"polygon,omitempty"`
+}
+
+// Contains reports whether the position is within the zone, the altitude is ignored.
+func (z Zone) Contains(p Position) bool {
+	if len(z.Polygon) != 0 {
+		return z.polygonContains(p)
+	}
+	if len(z.Center) != 2 {
+		return false
+	}
+	return math.Hypot(p.X-z.Center[0], p.Y-z.Center[1]) <= z.Radius
+}
+
+// polygonContains uses the ray casting algorithm: a position is within the polygon, if a ray from the position crosses
+// the edges of the polygon an odd number of times.
+func (z Zone) polygonContains(p Position) bool {
+	inside := false
+	for i, j := 0, len(z.Polygon)-1; i < len(z.Polygon); j, i = i, i+1 {
+		a, b := z.Polygon[i], z.Polygon[j]
+		if len(a) != 2 || len(b) != 2 {
+			return false
+		}
+		if (a[1] > p.Y) != (b[1] > p.Y) && p.X < (b[0]-a[0])*(p.Y-a[1])/(b[1]-a[1])+a[0] {
+			inside = !inside
+		}
+	}
+	return inside
+}
+
+// ZoneNames returns the zone names of the value of a withinZone rule, which is a name or a non-empty list of names, and
+// reports false for any other value.
+func ZoneNames(v interface{}) ([]string, bool) {
+	switch x := v.(type) {
+	case string:
+		return []string{x}, true
+	case []interface{}:
+		var names []string
+		for _, n := range x {
+			s, ok := n.(string)
+			if !ok {
+				return nil, false
+			}
+			names = append(names, s)
+		}
+		return names, len(names) != 0
+	case []string:
+		return x, len(x) != 0
+	}
+	return nil, false
+}
+
+// UseZones resolves the zones of all withinZone rules of the filters. Rules with unknown zones never match.
+func (l FilterList) UseZones(zones map[string]Zone) {
+	for i := range l {
+		l[i].Rules.useZones(zones)
+	}
+}
+
+func (l RuleList) useZones(zones map[string]Zone) {
+	for i := range l {
+		l[i].useZones(zones)
+	}
+}
+
+func (r *Rule) useZones(zones map[string]Zone) {
+	if r.Comparator == ComparatorWithinZone {
+		r.zones = nil
+		names, _ := ZoneNames(r.Value)
+		for _, name := range names {
+			if z, ok := zones[name]; ok {
+				r.zones = append(r.zones, z)
+			}
+		}
+	}
+	r.All.useZones(zones)
+	r.Any.useZones(zones)
+	if r.Not != nil {
+		r.Not.useZones(zones)
+	}
+}
+
+// withinZone reports whether the position of the field of the rule is within any of the zones of the rule.
+func (r Rule) withinZone(e Event) bool {
+	p, ok := e.position(r.Field)
+	if !ok {
+		return false
+	}
+	for _, z := range r.zones {
+		if z.Contains(p) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,140 @@
+package domain_test
+
+import (
+	"bytes"
+	"cftools-relay/internal/domain"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"net/http/httptest"
+	"os"
+	"time"
+)
+
+var _ = Describe("Zone", func() {
+	trader := domain.Zone{Center: []float64{4000, 9000}, Radius: 150}
+	base := domain.Zone{Polygon: [][]float64{{0, 0}, {100, 0}, {100, 100}, {50, 150}, {0, 100}}}
+
+	Context("ParsePosition", func() {
+		It("parses positions with labels", func() {
+			p, ok := domain.ParsePosition("<X: 4055.42, Y: 8895.48, Z: 324.61>")
+
+			Expect(ok).To(BeTrue())
+			Expect(p).To(Equal(domain.Position{X: 4055.42, Y: 8895.48, Z: 324.61}))
+		})
+
+		It("parses positions without labels", func() {
+			p, ok := domain.ParsePosition("<-12.5, 30, 2>")
+
+			Expect(ok).To(BeTrue())
+			Expect(p).To(Equal(domain.Position{X: -12.5, Y: 30, Z: 2}))
+		})
+
+		It("parses positions with the brackets sent by CFTools", func() {
+			p, ok := domain.ParsePosition("u003cX: 4055.42, Y: 8895.48, Z: 324.61u003e")
+
+			Expect(ok).To(BeTrue())
+			Expect(p).To(Equal(domain.Position{X: 4055.42, Y: 8895.48, Z: 324.61}))
+		})
+
+		It("does not parse other values", func() {
+			_, ok := domain.ParsePosition("somewhere near Cherno")
+
+			Expect(ok).To(BeFalse())
+		})
+	})
+
+	It("sets the coordinates of position fields", func() {
+		e := domain.Event{Values: map[string]interface{}{
+			"victim_position":   "<X: 4055.42, Y: 8895.48, Z: 324.61>",
+			"murderer_position": "unknown",
+			"victim_position_z": 1.0,
+		}}
+
+		e.ParsePositions()
+
+		Expect(e.Values).To(HaveKeyWithValue("victim_position_x", 4055.42))
+		Expect(e.Values).To(HaveKeyWithValue("victim_position_y", 8895.48))
+		Expect(e.Values).To(HaveKeyWithValue("victim_position_z", 1.0))
+		Expect(e.Values).ToNot(HaveKey("murderer_position_x"))
+	})
+
+	It("sets the coordinates of the positions of received events", func() {
+		payload, err := os.ReadFile("../../payloads/player.kill.json")
+		Expect(err).ToNot(HaveOccurred())
+		r := httptest.NewRequest("POST", "/cftools-webhook/pvp", bytes.NewReader(payload))
+		r.Header.Set("X-Hephaistos-Shard", "0")
+		r.Header.Set("X-Hephaistos-Event", domain.EventPlayerKill)
+
+		e, err := domain.WebhookFromRequest(r, time.Now)
+		Expect(err).ToNot(HaveOccurred())
+
+		Expect(e.Event.Values).To(HaveKeyWithValue("victim_position_x", 11969.0))
+		Expect(e.Event.Values).To(HaveKeyWithValue("victim_position_y", 9595.0))
+		Expect(e.Event.Values).To(HaveKeyWithValue("murderer_position_x", 11966.58))
+		Expect(e.Event.Values).To(HaveKeyWithValue("murderer_position_y", 9595.23))
+
+		l := domain.FilterList{{Event: domain.EventPlayerKill, Rules: domain.RuleList{{
+			Comparator: domain.ComparatorWithinZone,
+			Field:      "murderer_position",
+			Value:      "airfield",
+		}}}}
+		Expect(l.Compile()).To(Succeed())
+		l.UseZones(map[string]domain.Zone{"airfield": {Center: []float64{11950, 9600}, Radius: 50}})
+		m, _, err := l.MatchingFilters(nil, e.Event)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(m).To(BeTrue())
+	})
+
+	It("contains positions within the radius of a circle", func() {
+		Expect(trader.Contains(domain.Position{X: 4100, Y: 9100})).To(BeTrue())
+		Expect(trader.Contains(domain.Position{X: 4110, Y: 9110})).To(BeFalse())
+	})
+
+	It("contains positions within a polygon", func() {
+		Expect(base.Contains(domain.Position{X: 50, Y: 120})).To(BeTrue())
+		Expect(base.Contains(domain.Position{X: 10, Y: 130})).To(BeFalse())
+		Expect(base.Contains(domain.Position{X: 150, Y: 50})).To(BeFalse())
+	})
+
+	Context("withinZone", func() {
+		kill := func(position string) domain.Event {
+			e := domain.Event{Type: domain.EventPlayerKill, Timestamp: time.Now(), Values: map[string]interface{}{
+				domain.FieldMurdererCfToolsId: "AN_ID",
+				"victim_position":             position,
+			}}
+			e.ParsePositions()
+			return e
+		}
+		filters := func(value interface{}) domain.FilterList {
+			l := domain.FilterList{{Event: domain.EventPlayerKill, Rules: domain.RuleList{{
+				Comparator: domain.ComparatorWithinZone,
+				Field:      "victim_position",
+				Value:      value,
+			}}}}
+			Expect(l.Compile()).To(Succeed())
+			l.UseZones(map[string]domain.Zone{"trader": trader, "base": base})
+			return l
+		}
+
+		It("matches positions within the zone", func() {
+			m, _, err := filters("trader").MatchingFilters(nil, kill("<X: 4055.42, Y: 8895.48, Z: 324.61>"))
+
+			Expect(err).ToNot(HaveOccurred())
+			Expect(m).To(BeTrue())
+		})
+
+		It("matches positions within any of the zones", func() {
+			m, _, err := filters([]interface{}{"trader", "base"}).MatchingFilters(nil, kill("<X: 20, Y: 20, Z: 0>"))
+
+			Expect(err).ToNot(HaveOccurred())
+			Expect(m).To(BeTrue())
+		})
+
+		It("does not match positions outside of the zone or unknown positions", func() {
+			l := filters("trader")
+
+			Expect(l.MatchingFilters(nil, kill("<X: 20, Y: 20, Z: 0>"))).To(BeFalse())
+			Expect(l.MatchingFilters(nil, kill("unknown"))).To(BeFalse())
+		})
+	})
+})
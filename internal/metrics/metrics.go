@@ -0,0 +1,241 @@
+// Package metrics collects counters, histograms and gauges of the relay and exposes them in the Prometheus text format.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultBuckets are the upper bounds of histogram buckets in seconds, suitable for the latency of HTTP requests.
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30}
+
+type collector interface {
+	write(w io.Writer)
+}
+
+type registry struct {
+	lock       sync.Mutex
+	collectors []collector
+}
+
+var defaultRegistry = &registry{}
+
+func (r *registry) register(c collector) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.collectors = append(r.collectors, c)
+}
+
+func (r *registry) write(w io.Writer) {
+	r.lock.Lock()
+	collectors := append([]collector{}, r.collectors...)
+	r.lock.Unlock()
+
+	for _, c := range collectors {
+		c.write(w)
+	}
+}
+
+// Handler serves all registered metrics in the Prometheus text format.
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		defaultRegistry.write(w)
+	})
+}
+
+type series struct {
+	labels []string
+	value  float64
+}
+
+type counterVec struct {
+	name   string
+	help   string
+	labels []string
+	lock   sync.Mutex
+	series map[string]*series
+}
+
+// NewCounterVec registers a counter, which is partitioned by the given label names.
+func NewCounterVec(name, help string, labels ...string) *counterVec {
+	c := &counterVec{name: name, help: help, labels: labels, series: map[string]*series{}}
+	defaultRegistry.register(c)
+	return c
+}
+
+// Inc increments the counter of the given label values by one.
+func (c *counterVec) Inc(values ...string) {
+	c.Add(1, values...)
+}
+
+func (c *counterVec) Add(v float64, values ...string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	key := strings.Join(values, "\xff")
+	s, ok := c.series[key]
+	if !ok {
+		s = &series{labels: values}
+		c.series[key] = s
+	}
+	s.value += v
+}
+
+// Value returns the current value of the counter of the given label values.
+func (c *counterVec) Value(values ...string) float64 {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if s, ok := c.series[strings.Join(values, "\xff")]; ok {
+		return s.value
+	}
+	return 0
+}
+
+func (c *counterVec) write(w io.Writer) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	writeHeader(w, c.name, c.help, "counter")
+	for _, key := range sortedKeys(c.series) {
+		s := c.series[key]
+		fmt.Fprintf(w, "%s%s %s\n", c.name, formatLabels(c.labels, s.labels), formatValue(s.value))
+	}
+}
+
+type histogramSeries struct {
+	labels []string
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+type histogramVec struct {
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+	lock    sync.Mutex
+	series  map[string]*histogramSeries
+}
+
+// NewHistogramVec registers a histogram with the given bucket upper bounds, which is partitioned by the given label
+// names.
+func NewHistogramVec(name, help string, buckets []float64, labels ...string) *histogramVec {
+	h := &histogramVec{name: name, help: help, labels: labels, buckets: buckets, series: map[string]*histogramSeries{}}
+	defaultRegistry.register(h)
+	return h
+}
+
+func (h *histogramVec) Observe(v float64, values ...string) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	key := strings.Join(values, "\xff")
+	s, ok := h.series[key]
+	if !ok {
+		s = &histogramSeries{labels: values, counts: make([]uint64, len(h.buckets))}
+		h.series[key] = s
+	}
+	for i, upper := range h.buckets {
+		if v <= upper {
+			s.counts[i]++
+		}
+	}
+	s.sum += v
+	s.count++
+}
+
+func (h *histogramVec) write(w io.Writer) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	writeHeader(w, h.name, h.help, "histogram")
+	labels := append(append([]string{}, h.labels...), "le")
+	for _, key := range sortedKeys(h.series) {
+		s := h.series[key]
+		for i, upper := range h.buckets {
+			values := append(append([]string{}, s.labels...), formatValue(upper))
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(labels, values), s.counts[i])
+		}
+		values := append(append([]string{}, s.labels...), "+Inf")
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(labels, values), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, formatLabels(h.labels, s.labels), formatValue(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, formatLabels(h.labels, s.labels), s.count)
+	}
+}
+
+type gaugeFunc struct {
+	name string
+	help string
+	f    func() float64
+}
+
+// NewGaugeFunc registers a gauge, whose value is determined by calling f whenever the metrics are collected.
+func NewGaugeFunc(name, help string, f func() float64) *gaugeFunc {
+	g := &gaugeFunc{name: name, help: help, f: f}
+	defaultRegistry.register(g)
+	return g
+}
+
+func (g *gaugeFunc) write(w io.Writer) {
+	writeHeader(w, g.name, g.help, "gauge")
+	fmt.Fprintf(w, "%s %s\n", g.name, formatValue(g.f()))
+}
+
+func writeHeader(w io.Writer, name, help, kind string) {
+	fmt.Fprintf(w, "# HELP %s %s\n", name, strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(help))
+	fmt.Fprintf(w, "# TYPE %s %s\n", name, kind)
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+
+func formatLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	var pairs []string
+	for i, name := range names {
+		value := ""
+		if i < len(values) {
+			value = values[i]
+		}
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, name, labelValueEscaper.Replace(value)))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func sortedKeys(m interface{}) []string {
+	var keys []string
+	switch x := m.(type) {
+	case map[string]*series:
+		for k := range x {
+			keys = append(keys, k)
+		}
+	case map[string]*histogramSeries:
+		for k := range x {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
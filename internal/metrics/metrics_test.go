@@ -0,0 +1,54 @@
+package metrics_test
+
+import (
+	"cftools-relay/internal/metrics"
+	"net/http/httptest"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+func scrape() string {
+	w := httptest.NewRecorder()
+	metrics.Handler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	return w.Body.String()
+}
+
+var _ = Describe("Metrics", func() {
+	It("exposes counters per label values", func() {
+		c := metrics.NewCounterVec("test_events_total", "Events for testing.", "server", "event")
+		c.Inc("pvp", "player.kill")
+		c.Inc("pvp", "player.kill")
+		c.Add(3, `a "quoted"\ server`, "user.join")
+
+		Expect(c.Value("pvp", "player.kill")).To(Equal(float64(2)))
+		Expect(scrape()).To(ContainSubstring(`# HELP test_events_total Events for testing.
+# TYPE test_events_total counter
+test_events_total{server="a \"quoted\"\\ server",event="user.join"} 3
+test_events_total{server="pvp",event="player.kill"} 2
+`))
+	})
+
+	It("exposes cumulative histogram buckets", func() {
+		h := metrics.NewHistogramVec("test_duration_seconds", "Durations for testing.", []float64{0.1, 1}, "target")
+		h.Observe(0.05, "default")
+		h.Observe(0.5, "default")
+		h.Observe(5, "default")
+
+		Expect(scrape()).To(ContainSubstring(`# TYPE test_duration_seconds histogram
+test_duration_seconds_bucket{target="default",le="0.1"} 1
+test_duration_seconds_bucket{target="default",le="1"} 2
+test_duration_seconds_bucket{target="default",le="+Inf"} 3
+test_duration_seconds_sum{target="default"} 5.55
+test_duration_seconds_count{target="default"} 3
+`))
+	})
+
+	It("exposes gauges with their current value", func() {
+		v := 1.0
+		metrics.NewGaugeFunc("test_size_bytes", "Size for testing.", func() float64 { return v })
+		v = 42
+
+		Expect(scrape()).To(ContainSubstring("# TYPE test_size_bytes gauge\ntest_size_bytes 42\n"))
+	})
+})
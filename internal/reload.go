@@ -0,0 +1,165 @@
+package internal
+
+import (
+	"code.cloudfoundry.org/lager"
+	"encoding/json"
+	"fmt"
+	"github.com/fsnotify/fsnotify"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+const reloadDebounce = 500 * time.Millisecond
+
+// Diff lists the differences between the config c and the newer config n in a human-readable form.
+func (c Config) Diff(n Config) []string {
+	var changes []string
+	changes = append(changes, diffMap("servers", toJsonMap(c.Servers), toJsonMap(n.Servers))...)
+	changes = append(changes, diffMap("targets", toJsonMap(c.Targets), toJsonMap(n.Targets))...)
+	changes = append(changes, diffMap("zones", toJsonMap(c.Zones), toJsonMap(n.Zones))...)
+
+	for i := 0; i < len(c.Filter) || i < len(n.Filter); i++ {
+		path := fmt.Sprintf("filter[%d]", i)
+		switch {
+		case i >= len(n.Filter):
+			changes = append(changes, path+": removed")
+		case i >= len(c.Filter):
+			changes = append(changes, path+": added")
+		case toJson(c.Filter[i]) != toJson(n.Filter[i]):
+			changes = append(changes, path+": changed")
+		}
+	}
+
+	if c.Port != n.Port {
+		changes = append(changes, "port: changed, requires a restart")
+	}
+	if c.AdminPort != n.AdminPort {
+		changes = append(changes, "admin_port: changed, requires a restart")
+	}
+	if toJson(c.History) != toJson(n.History) {
+		changes = append(changes, "history: changed, requires a restart")
+	}
+	if c.Delivery != n.Delivery {
+		changes = append(changes, "delivery: changed, requires a restart")
+	}
+	if c.Processing != n.Processing {
+		changes = append(changes, "processing: changed, requires a restart")
+	}
+	if c.Shutdown != n.Shutdown {
+		changes = append(changes, "shutdown: changed, requires a restart")
+	}
+	if toJson(c.Deduplication) != toJson(n.Deduplication) {
+		changes = append(changes, "deduplication: changed, requires a restart")
+	}
+	if c.Sessions != n.Sessions {
+		changes = append(changes, "sessions: changed, requires a restart")
+	}
+	return changes
+}
+
+func diffMap(path string, old, new map[string]string) []string {
+	var keys []string
+	for k := range old {
+		keys = append(keys, k)
+	}
+	for k := range new {
+		if _, ok := old[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	var changes []string
+	for _, k := range keys {
+		o, inOld := old[k]
+		n, inNew := new[k]
+		switch {
+		case !inNew:
+			changes = append(changes, fmt.Sprintf("%s.%s: removed", path, k))
+		case !inOld:
+			changes = append(changes, fmt.Sprintf("%s.%s: added", path, k))
+		case o != n:
+			changes = append(changes, fmt.Sprintf("%s.%s: changed", path, k))
+		}
+	}
+	return changes
+}
+
+func toJsonMap(m interface{}) map[string]string {
+	var values map[string]json.RawMessage
+	_ = json.Unmarshal([]byte(toJson(m)), &values)
+	res := map[string]string{}
+	for k, v := range values {
+		res[k] = string(v)
+	}
+	return res
+}
+
+func toJson(v interface{}) string {
+	c, _ := json.Marshal(v)
+	return string(c)
+}
+
+type configWatcher struct {
+	watcher *fsnotify.Watcher
+	changes chan struct{}
+}
+
+// WatchConfig notifies about changes of the config file at path. The directory of the file is watched, as editors
+// usually replace the file instead of writing into it.
+func WatchConfig(path string, logger lager.Logger) (*configWatcher, error) {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := w.Add(filepath.Dir(abs)); err != nil {
+		_ = w.Close()
+		return nil, err
+	}
+	cw := &configWatcher{
+		watcher: w,
+		changes: make(chan struct{}, 1),
+	}
+	go cw.run(abs, logger.Session("watch-config"))
+	return cw, nil
+}
+
+func (w *configWatcher) Changes() <-chan struct{} {
+	return w.changes
+}
+
+func (w *configWatcher) Close() error {
+	return w.watcher.Close()
+}
+
+func (w *configWatcher) run(path string, logger lager.Logger) {
+	var debounce <-chan time.Time
+	for {
+		select {
+		case e, ok := <-w.watcher.Events:
+			if !ok {
+				return
+			}
+			if filepath.Clean(e.Name) != path || e.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename) == 0 {
+				continue
+			}
+			debounce = time.After(reloadDebounce)
+		case err, ok := <-w.watcher.Errors:
+			if !ok {
+				return
+			}
+			logger.Error("watch", err)
+		case <-debounce:
+			debounce = nil
+			select {
+			case w.changes <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package internal_test
+
+import (
+	"cftools-relay/internal"
+	"cftools-relay/internal/domain"
+	"code.cloudfoundry.org/lager"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+var _ = Describe("Reload", func() {
+	Context("Diff", func() {
+		base := internal.Config{
+			Port: 8080,
+			Servers: map[string]domain.Server{
+				"pvp": {Secret: "a"},
+				"pve": {Secret: "b"},
+			},
+			Targets: map[string]domain.TargetConfig{
+				domain.DefaultTarget: {Type: domain.TargetTypeDiscord, WebhookUrl: "http://a"},
+			},
+			Filter: domain.FilterList{{Event: domain.EventPlayerKill}, {Event: domain.EventUserJoin}},
+		}
+
+		It("reports no changes for the same config", func() {
+			Expect(base.Diff(base)).To(BeEmpty())
+		})
+
+		It("lists what changed", func() {
+			n := internal.Config{
+				Port: 8081,
+				Servers: map[string]domain.Server{
+					"pvp": {Secret: "changed"},
+					"new": {Secret: "c"},
+				},
+				Targets: base.Targets,
+				Filter:  domain.FilterList{{Event: domain.EventPlayerKill}, {Event: domain.EventUserLeave}, {Event: domain.EventUserChat}},
+			}
+
+			Expect(base.Diff(n)).To(Equal([]string{
+				"servers.new: added",
+				"servers.pve: removed",
+				"servers.pvp: changed",
+				"filter[1]: changed",
+				"filter[2]: added",
+				"port: changed, requires a restart",
+			}))
+		})
+
+		It("lists changed zones", func() {
+			c := base
+			c.Zones = map[string]domain.Zone{"trader": {Center: []float64{0, 0}, Radius: 100}}
+			n := base
+			n.Zones = map[string]domain.Zone{"trader": {Center: []float64{0, 0}, Radius: 150}, "military": {Center: []float64{10, 10}, Radius: 50}}
+
+			Expect(c.Diff(n)).To(Equal([]string{
+				"zones.military: added",
+				"zones.trader: changed",
+			}))
+		})
+	})
+
+	Context("WatchConfig", func() {
+		var tmpPath string
+
+		BeforeEach(func() {
+			path, err := os.MkdirTemp("", "test-watch")
+			if err != nil {
+				panic(err)
+			}
+			tmpPath = path
+		})
+
+		AfterEach(func() {
+			err := os.RemoveAll(tmpPath)
+			if err != nil {
+				panic(err)
+			}
+		})
+
+		It("notifies about changes of the config file only", func() {
+			path := filepath.Join(tmpPath, "config.json")
+			Expect(os.WriteFile(path, []byte(`{}`), 0600)).To(Succeed())
+			w, err := internal.WatchConfig(path, lager.NewLogger("test"))
+			Expect(err).ToNot(HaveOccurred())
+			defer w.Close()
+
+			Expect(os.WriteFile(filepath.Join(tmpPath, "other.json"), []byte(`{}`), 0600)).To(Succeed())
+			Consistently(w.Changes(), 700*time.Millisecond).ShouldNot(Receive())
+
+			Expect(os.WriteFile(path, []byte(`{"port": 8081}`), 0600)).To(Succeed())
+			Eventually(w.Changes(), 2*time.Second).Should(Receive())
+		})
+	})
+})
@@ -0,0 +1,511 @@
+package internal
+
+import (
+	"cftools-relay/internal/domain"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+type ValidationError struct {
+	Path    string
+	Message string
+}
+
+func (e ValidationError) Error() string {
+	return e.Path + ": " + e.Message
+}
+
+type ValidationErrors []ValidationError
+
+func (e ValidationErrors) Error() string {
+	var messages []string
+	for _, err := range e {
+		messages = append(messages, err.Error())
+	}
+	return fmt.Sprintf("%d problem(s) in config:\n%s", len(e), strings.Join(messages, "\n"))
+}
+
+type validator struct {
+	errors ValidationErrors
+	zones  map[string]domain.Zone
+}
+
+func (v *validator) report(path, format string, args ...interface{}) {
+	v.errors = append(v.errors, ValidationError{Path: path, Message: fmt.Sprintf(format, args...)})
+}
+
+func (v *validator) duration(path, d string) {
+	if _, err := time.ParseDuration(d); err != nil {
+		v.report(path, "invalid duration %q", d)
+	}
+}
+
+func (v *validator) positiveDuration(path, d string) {
+	parsed, err := time.ParseDuration(d)
+	if err != nil {
+		v.report(path, "invalid duration %q", d)
+	} else if parsed <= 0 {
+		v.report(path, "expected a positive duration, got %q", d)
+	}
+}
+
+// Validate checks the config for problems, which would otherwise only be noticed when an event is processed, or not
+// at all. All problems are reported at once, each with the JSON path of the invalid value.
+func (c Config) Validate() ValidationErrors {
+	v := &validator{zones: c.Zones}
+
+	if c.AdminPort != 0 && c.AdminPort == c.Port {
+		v.report("admin_port", "expected a different port than port %d", c.Port)
+	}
+
+	var servers []string
+	for name := range c.Servers {
+		servers = append(servers, name)
+	}
+	sort.Strings(servers)
+	for _, name := range servers {
+		if url.PathEscape(name) != name {
+			v.report("servers."+name, "%q is expected to be URL-safe", name)
+		}
+	}
+	var targets []string
+	for name := range c.Targets {
+		targets = append(targets, name)
+	}
+	sort.Strings(targets)
+	for _, name := range targets {
+		if t := c.Targets[name].Type; t != domain.TargetTypeDiscord {
+			v.report("targets."+name+".type", "unknown %q", t)
+		}
+		v.webhookUrl("targets."+name+".webhook_url", c.Targets[name].WebhookUrl)
+	}
+	if d := c.History.Driver; d != HistoryDriverFile && d != HistoryDriverSqlite {
+		v.report("history.driver", "unknown %q, expected %q or %q", d, HistoryDriverFile, HistoryDriverSqlite)
+	}
+	if c.History.MaxEventsPerPlayer < 1 {
+		v.report("history.max_events_per_player", "expected at least 1, got %d", c.History.MaxEventsPerPlayer)
+	}
+	if c.History.MaxAge != "" {
+		v.duration("history.max_age", c.History.MaxAge)
+	}
+	var eventTypes []string
+	for eventType := range c.History.EventTypes {
+		eventTypes = append(eventTypes, eventType)
+	}
+	sort.Strings(eventTypes)
+	for _, eventType := range eventTypes {
+		r := c.History.EventTypes[eventType]
+		if r.MaxEventsPerPlayer < 0 {
+			v.report("history.event_types."+eventType+".max_events_per_player", "expected at least 1, got %d", r.MaxEventsPerPlayer)
+		}
+		if r.MaxAge != "" {
+			v.duration("history.event_types."+eventType+".max_age", r.MaxAge)
+		}
+	}
+	if c.Delivery.MaxAttempts < 1 {
+		v.report("delivery.max_attempts", "expected at least 1, got %d", c.Delivery.MaxAttempts)
+	}
+	v.duration("delivery.initial_backoff", c.Delivery.InitialBackoff)
+	v.duration("delivery.max_backoff", c.Delivery.MaxBackoff)
+	if c.Processing.Workers < 1 {
+		v.report("processing.workers", "expected at least 1, got %d", c.Processing.Workers)
+	}
+	if c.Processing.QueueSize < c.Processing.Workers {
+		v.report("processing.queue_size", "expected at least the number of workers (%d), got %d", c.Processing.Workers, c.Processing.QueueSize)
+	}
+	v.duration("shutdown.timeout", c.Shutdown.Timeout)
+	v.positiveDuration("deduplication.ttl", c.Deduplication.TTL)
+	v.positiveDuration("sessions.stale_timeout", c.Sessions.StaleTimeout)
+	var zones []string
+	for name := range c.Zones {
+		zones = append(zones, name)
+	}
+	sort.Strings(zones)
+	for _, name := range zones {
+		v.zone("zones."+name, c.Zones[name])
+	}
+
+	names := map[string]bool{}
+	v.filters("filter", c.Filter, c.Targets, names)
+	for _, name := range servers {
+		path := "servers." + name
+		for i, target := range c.Servers[name].Targets {
+			if _, ok := c.Targets[target]; !ok {
+				v.report(fmt.Sprintf("%s.targets[%d]", path, i), "unknown target %q", target)
+			}
+		}
+		v.filters(path+".filter", c.Servers[name].Filter, c.Targets, names)
+	}
+	if _, ok := c.Targets[domain.DefaultTarget]; !ok {
+		v.defaultTargets(c, servers)
+	}
+	return v.errors
+}
+
+func (v *validator) webhookUrl(path, u string) {
+	if u == "" {
+		v.report(path, "missing")
+		return
+	}
+	parsed, err := url.Parse(u)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		v.report(path, "expected an absolute http(s) URL, got %q", u)
+	}
+}
+
+// defaultTargets reports the filters and servers, which relay events to the default target, as they have no targets on
+// their own, when the default target is not configured.
+func (v *validator) defaultTargets(c Config, servers []string) {
+	reported := map[int]bool{}
+	for _, name := range servers {
+		s := c.Servers[name]
+		if len(s.Targets) != 0 {
+			continue
+		}
+		if len(s.Filters(c.Filter)) == 0 {
+			v.report("servers."+name+".targets", "missing, events are relayed to the %q target, which is not configured", domain.DefaultTarget)
+			continue
+		}
+		if !s.IgnoreGlobalFilter {
+			for i, f := range c.Filter {
+				if len(f.Targets) == 0 && !reported[i] {
+					reported[i] = true
+					v.report(fmt.Sprintf("filter[%d].targets", i), "missing, events of server %q are relayed to the %q target, which is not configured", name, domain.DefaultTarget)
+				}
+			}
+		}
+		for i, f := range s.Filter {
+			if len(f.Targets) == 0 {
+				v.report(fmt.Sprintf("servers.%s.filter[%d].targets", name, i), "missing, events are relayed to the %q target, which is not configured", domain.DefaultTarget)
+			}
+		}
+	}
+}
+
+// filters validates each filter of l. The names of the filters need to be unique across all lists, names holds the
+// names seen so far.
+func (v *validator) filters(path string, l domain.FilterList, targets map[string]domain.TargetConfig, names map[string]bool) {
+	for i, filter := range l {
+		p := fmt.Sprintf("%s[%d]", path, i)
+		if filter.Name != "" && names[filter.Name] {
+			v.report(p+".name", "duplicate name %q", filter.Name)
+		}
+		names[filter.Name] = true
+		v.filter(p, filter, targets)
+	}
+}
+
+func (v *validator) filter(path string, f domain.Filter, targets map[string]domain.TargetConfig) {
+	if f.Event == "" {
+		v.report(path+".event", "missing")
+	} else if !domain.IsEventType(f.Event) {
+		v.report(path+".event", "unknown event type %q", f.Event)
+	}
+	for i, name := range f.Targets {
+		if _, ok := targets[name]; !ok {
+			v.report(fmt.Sprintf("%s.targets[%d]", path, i), "unknown target %q", name)
+		}
+	}
+	if f.Color != "" && !domain.IsColor(string(f.Color)) {
+		v.report(path+".color", "unknown %q", f.Color)
+	}
+	if f.Schedule != nil {
+		v.schedule(path+".schedule", *f.Schedule)
+	}
+	if f.Format != nil {
+		v.format(path+".format", *f.Format)
+	}
+	v.rules(path+".rules", f.Rules)
+}
+
+func (v *validator) format(path string, f domain.Format) {
+	switch f.Type {
+	case "", domain.FormatTypeRich:
+		if c, ok := f.Parameters["color"]; ok {
+			color, isString := c.(string)
+			if !isString {
+				v.report(path+".parameters.color", "expected a color name")
+			} else if color != "" && !domain.IsColor(color) {
+				v.report(path+".parameters.color", "unknown %q", color)
+			}
+		}
+		if m, ok := f.Parameters["message"]; ok {
+			if _, isString := m.(string); !isString {
+				v.report(path+".parameters.message", "expected a text")
+			}
+		}
+	case domain.FormatTypeText:
+		if t, ok := f.Parameters["template"]; ok {
+			tpl, isString := t.(string)
+			if !isString {
+				v.report(path+".parameters.template", "expected a text")
+			} else if _, err := template.New("").Parse(tpl); err != nil {
+				v.report(path+".parameters.template", "invalid template: %s", err.Error())
+			}
+		}
+	default:
+		v.report(path+".type", "unknown %q", f.Type)
+	}
+}
+
+func (v *validator) rules(path string, l domain.RuleList) {
+	for i, rule := range l {
+		v.rule(fmt.Sprintf("%s[%d]", path, i), rule)
+	}
+}
+
+func (v *validator) rule(path string, r domain.Rule) {
+	if r.All != nil {
+		if len(r.All) == 0 {
+			v.report(path+".all", "expected at least one rule")
+		}
+		v.rules(path+".all", r.All)
+	}
+	if r.Any != nil {
+		if len(r.Any) == 0 {
+			v.report(path+".any", "expected at least one rule")
+		}
+		v.rules(path+".any", r.Any)
+	}
+	if r.Not != nil {
+		v.rule(path+".not", *r.Not)
+	}
+	if r.IsGroup() && r.Comparator == "" {
+		return
+	}
+
+	if !domain.IsComparator(r.Comparator) {
+		if r.Comparator == "" {
+			v.report(path+".comparator", "missing")
+		} else {
+			v.report(path+".comparator", "unknown %q", r.Comparator)
+		}
+	}
+	if r.Field == "" {
+		v.report(path+".field", "missing")
+	} else if strings.HasPrefix(r.Field, "vf_") && !domain.IsVirtualField(r.Field) {
+		v.report(path+".field", "unknown virtual field %q", r.Field)
+	}
+	if r.Since != "" {
+		v.duration(path+".since", r.Since)
+	}
+	if !domain.IsScope(r.Scope) {
+		v.report(path+".scope", "unknown %q, expected %q or %q", r.Scope, domain.ScopeServer, domain.ScopeGlobal)
+	} else if r.Scope != "" && !domain.IsVirtualField(r.Field) {
+		v.report(path+".scope", "only applies to virtual fields")
+	}
+	if !domain.IsSubject(r.Subject) {
+		v.report(path+".subject", "unknown %q, expected %q, %q or %q", r.Subject, domain.SubjectPlayer, domain.SubjectVictim, domain.SubjectMurderer)
+	} else if r.Subject != "" && (!domain.IsVirtualField(r.Field) || r.Field == domain.VirtualFieldPairEventCount || domain.IsSessionField(r.Field)) {
+		v.report(path+".subject", "only applies to virtual fields of a single player")
+	}
+	if domain.IsAggregateField(r.Field) {
+		if r.SourceField == "" {
+			v.report(path+".source_field", "missing, required by %s", r.Field)
+		}
+	} else {
+		if r.SourceField != "" {
+			v.report(path+".source_field", "only applies to aggregate virtual fields")
+		}
+		if r.SourceEvent != "" {
+			v.report(path+".source_event", "only applies to aggregate virtual fields")
+		}
+	}
+
+	switch r.Comparator {
+	case domain.ComparatorExists, domain.ComparatorMissing:
+	case domain.ComparatorGreaterThan, domain.ComparatorGreaterThanOrEqual, domain.ComparatorLessThan, domain.ComparatorLessThanOrEqual:
+		if !isNumber(r.Value) {
+			v.report(path+".value", "expected a number, got %s", describe(r.Value))
+		}
+	case domain.ComparatorBetween:
+		bounds, ok := r.Value.([]interface{})
+		if !ok || len(bounds) != 2 || !isNumber(bounds[0]) || !isNumber(bounds[1]) {
+			v.report(path+".value", "expected a list of two numbers, got %s", describe(r.Value))
+		}
+	case domain.ComparatorWithinZone:
+		names, ok := domain.ZoneNames(r.Value)
+		if !ok {
+			v.report(path+".value", "expected the name or a list of names of zones, got %s", describe(r.Value))
+		}
+		for _, name := range names {
+			if _, known := v.zones[name]; !known {
+				v.report(path+".value", "unknown zone %q", name)
+			}
+		}
+	case domain.ComparatorMatches:
+		p, ok := r.Value.(string)
+		if !ok {
+			v.report(path+".value", "expected a regular expression, got %s", describe(r.Value))
+		} else if _, err := regexp.Compile(p); err != nil {
+			v.report(path+".value", "invalid regular expression: %s", err.Error())
+		}
+	default:
+		if r.Value == nil {
+			v.report(path+".value", "missing")
+		}
+	}
+}
+
+func (v *validator) schedule(path string, s domain.Schedule) {
+	if s.TimeZone != "" {
+		if _, err := time.LoadLocation(s.TimeZone); err != nil {
+			v.report(path+".time_zone", "unknown %q", s.TimeZone)
+		}
+	}
+	for i, d := range s.Weekdays {
+		if !domain.IsWeekday(d) {
+			v.report(fmt.Sprintf("%s.weekdays[%d]", path, i), "unknown %q, expected a weekday like %q", d, "monday")
+		}
+	}
+	for i, r := range s.Times {
+		p := fmt.Sprintf("%s.times[%d]", path, i)
+		from, errFrom := domain.ParseClock(r.From)
+		if errFrom != nil {
+			v.report(p+".from", "%s", errFrom)
+		}
+		to, errTo := domain.ParseClock(r.To)
+		if errTo != nil {
+			v.report(p+".to", "%s", errTo)
+		}
+		if errFrom == nil && errTo == nil && from == to {
+			v.report(p, "expected different times for from and to, got %s", r.From)
+		}
+	}
+}
+
+func (v *validator) zone(path string, z domain.Zone) {
+	switch {
+	case len(z.Polygon) != 0 && (len(z.Center) != 0 || z.Radius != 0):
+		v.report(path, "expected either center and radius or polygon")
+	case len(z.Polygon) != 0:
+		if len(z.Polygon) < 3 {
+			v.report(path+".polygon", "expected at least 3 corners, got %d", len(z.Polygon))
+		}
+		for i, corner := range z.Polygon {
+			if len(corner) != 2 {
+				v.report(fmt.Sprintf("%s.polygon[%d]", path, i), "expected X and Y, got %d coordinates", len(corner))
+			}
+		}
+	default:
+		if len(z.Center) != 2 {
+			v.report(path+".center", "expected X and Y, got %d coordinates", len(z.Center))
+		}
+		if z.Radius <= 0 {
+			v.report(path+".radius", "expected a positive number, got %v", z.Radius)
+		}
+	}
+}
+
+func isNumber(v interface{}) bool {
+	switch x := v.(type) {
+	case json.Number:
+		_, err := x.Float64()
+		return err == nil
+	case float64, float32, int, int64:
+		return true
+	case string:
+		_, err := strconv.ParseFloat(x, 64)
+		return err == nil
+	}
+	return false
+}
+
+func describe(v interface{}) string {
+	if v == nil {
+		return "nothing"
+	}
+	c, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprintf("%v", v)
+	}
+	return string(c)
+}
+
+// Warnings reports settings, which are valid, but most likely do not work as expected. E.g. rules, which count more
+// events than the history keeps.
+func (c Config) Warnings() ValidationErrors {
+	v := &validator{}
+	retention := c.History.Retention()
+	for i, filter := range c.Filter {
+		v.retentionWarnings(fmt.Sprintf("filter[%d].rules", i), filter.Rules, retention, filter.Event)
+	}
+	var servers []string
+	for name := range c.Servers {
+		servers = append(servers, name)
+	}
+	sort.Strings(servers)
+	for _, name := range servers {
+		for i, filter := range c.Servers[name].Filter {
+			v.retentionWarnings(fmt.Sprintf("servers.%s.filter[%d].rules", name, i), filter.Rules, retention, filter.Event)
+		}
+	}
+	return v.errors
+}
+
+func (v *validator) retentionWarnings(path string, l domain.RuleList, retention domain.RetentionPolicy, eventType string) {
+	for i, rule := range l {
+		p := fmt.Sprintf("%s[%d]", path, i)
+		v.retentionWarnings(p+".all", rule.All, retention, eventType)
+		v.retentionWarnings(p+".any", rule.Any, retention, eventType)
+		if rule.Not != nil {
+			v.retentionWarnings(p+".not", domain.RuleList{*rule.Not}, retention, eventType)
+		}
+
+		// historyType is the type of the events in the history, which the virtual field is evaluated with. counted is
+		// true, if the value of the field is a number of these events.
+		historyType, counted := eventType, true
+		since := domain.DefaultSince
+		switch {
+		case rule.Field == domain.VirtualFieldEventCount, rule.Field == domain.VirtualFieldPairEventCount:
+		case rule.Field == domain.VirtualFieldKillStreak:
+			// without since, the kill streak is evaluated with all kills, which the history keeps.
+			historyType, since = domain.EventPlayerKill, 0
+		case domain.IsAggregateField(rule.Field):
+			if rule.SourceEvent != "" {
+				historyType = rule.SourceEvent
+			}
+			counted = rule.Field == domain.VirtualFieldDistinctCount
+		default:
+			continue
+		}
+		if rule.Since != "" {
+			since, _ = time.ParseDuration(rule.Since)
+		}
+
+		r := retention.For(historyType)
+		if r.MaxAge != 0 && since > r.MaxAge {
+			v.report(p+".since", "%s exceeds the max_age of the history of %s events (%s), older events are not counted", since, historyType, r.MaxAge)
+		}
+		if needed := requiredEvents(rule); counted && needed > r.MaxEventsPerPlayer {
+			v.report(p+".value", "needs %d events, but the history keeps %d %s events per player and server only", needed, r.MaxEventsPerPlayer, historyType)
+		}
+	}
+}
+
+// requiredEvents returns the number of events, which are needed at least for a numeric comparison to match.
+func requiredEvents(r domain.Rule) int {
+	value := r.Value
+	if bounds, ok := r.Value.([]interface{}); ok && r.Comparator == domain.ComparatorBetween && len(bounds) == 2 {
+		value = bounds[0]
+	}
+	if !isNumber(value) {
+		return 0
+	}
+	n, _ := strconv.ParseFloat(fmt.Sprintf("%v", value), 64)
+	switch r.Comparator {
+	case domain.ComparatorGreaterThan:
+		return int(math.Floor(n)) + 1
+	case domain.ComparatorGreaterThanOrEqual, domain.ComparatorEquals, domain.ComparatorBetween:
+		return int(math.Ceil(n))
+	}
+	return 0
+}